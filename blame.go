@@ -0,0 +1,500 @@
+package filetree
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxBlameLine bounds a single line of blame output, which includes the
+// blamed source line itself.
+const maxBlameLine = 1024 * 1024
+
+// AuthorStat is one author's share of a file or directory.
+type AuthorStat struct {
+	Name       string  `json:"name,omitempty"`
+	Email      string  `json:"email"`
+	Count      int     `json:"lines"`
+	Percentage float64 `json:"percentage"`
+	// Others marks a synthetic entry summing the authors left out of a
+	// truncated list
+	Others bool `json:"others,omitempty"`
+}
+
+// Contribution metrics for BlameOptions.Metric.
+const (
+	MetricLines   = "lines"
+	MetricCommits = "commits"
+)
+
+// Blame backends for BlameOptions.Backend.
+const (
+	BackendGit   = "git"
+	BackendGoGit = "go-git"
+)
+
+// BlameOptions controls how FileContributions invokes git blame.
+type BlameOptions struct {
+	// Backend is BackendGit (the default) to run the git binary or
+	// BackendGoGit to blame in-process with go-git, which needs no git
+	// installed but only sees committed lines and supports none of
+	// MailmapFile, IgnoreWhitespace, DetectMoves and SinceCommit. The
+	// repository's .mailmap isn't applied either.
+	Backend string
+	// MailmapFile is an extra .mailmap used to collapse an author's addresses
+	// into one canonical email. The repository's own .mailmap is always
+	// applied by git blame itself.
+	MailmapFile string
+	// Metric is MetricLines (the default) to count blamed lines or
+	// MetricCommits to count distinct commits per author
+	Metric string
+	// IgnoreWhitespace passes -w so whitespace-only changes, like a
+	// reformatting commit, don't reattribute lines
+	IgnoreWhitespace bool
+	// DetectMoves passes -M -C so code moved or copied between files stays
+	// attributed to its original author. This makes blame noticeably slower.
+	DetectMoves bool
+	// Since, if non-zero, only counts lines authored at or after this time
+	Since time.Time
+	// Ref, if set, blames each file as of this revision instead of the
+	// working tree
+	Ref string
+	// SinceCommit, if set, only counts lines from commits that aren't
+	// ancestors of this revision, i.e. the lines new since it
+	SinceCommit string
+}
+
+// InsideWorkTree reports whether dir is inside a git work tree, which
+// FileContributions needs to blame anything.
+func InsideWorkTree(dir string) bool {
+	_, _, ok := findRepo(dir)
+	return ok
+}
+
+// Contributions is the blame result for a file, or the aggregate of every
+// file in a directory.
+type Contributions struct {
+	// Counts maps each canonical author email to their contribution under
+	// the chosen metric
+	Counts map[string]int
+	// Total is the sum of Counts
+	Total int
+	// Commits maps each author email to the set of commit shas counted for
+	// them. It is only set under MetricCommits, where a commit touching
+	// several files must be counted once when they are merged, so Add
+	// unions it and recomputes Counts from it.
+	Commits map[string]map[string]bool
+	// Names maps each author email to the display name git reports for it
+	Names map[string]string
+	// Latest is the most recent author time of any counted line
+	Latest time.Time
+	// LatestBy maps each author email to the most recent author time of
+	// their lines. It is only set on a single file's blame result, so that
+	// Latest can be recomputed when authors are left out, and isn't merged
+	// by Add.
+	LatestBy map[string]time.Time
+}
+
+// Add merges other into c.
+func (c *Contributions) Add(other Contributions) {
+	if c.Counts == nil {
+		c.Counts = make(map[string]int)
+	}
+	if c.Names == nil {
+		c.Names = make(map[string]string)
+	}
+	if other.Commits != nil {
+		if c.Commits == nil {
+			c.Commits = make(map[string]map[string]bool)
+		}
+		for author, commits := range other.Commits {
+			set := c.Commits[author]
+			if set == nil {
+				set = make(map[string]bool, len(commits))
+				c.Commits[author] = set
+			}
+			for commit := range commits {
+				set[commit] = true
+			}
+			c.Total += len(set) - c.Counts[author]
+			c.Counts[author] = len(set)
+		}
+	} else {
+		for author, count := range other.Counts {
+			c.Counts[author] += count
+			c.Total += count
+		}
+	}
+	for author, name := range other.Names {
+		c.Names[author] = name
+	}
+	if other.Latest.After(c.Latest) {
+		c.Latest = other.Latest
+	}
+}
+
+// CheckBackend reports whether opts.Backend exists and supports the rest of
+// opts.
+func CheckBackend(opts BlameOptions) error {
+	switch opts.Backend {
+	case "", BackendGit:
+		return nil
+	case BackendGoGit:
+	default:
+		return fmt.Errorf("unknown blame backend %q (want %s or %s)", opts.Backend, BackendGit, BackendGoGit)
+	}
+	var unsupported []string
+	if opts.MailmapFile != "" {
+		unsupported = append(unsupported, "a mailmap file")
+	}
+	if opts.IgnoreWhitespace {
+		unsupported = append(unsupported, "ignoring whitespace")
+	}
+	if opts.DetectMoves {
+		unsupported = append(unsupported, "detecting moves")
+	}
+	if opts.SinceCommit != "" {
+		unsupported = append(unsupported, "a since commit")
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("the %s blame backend doesn't support %s", BackendGoGit, strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+// FileContributions runs git blame on path and returns the contribution of
+// each canonical author email under opts.Metric.
+func FileContributions(ctx context.Context, path string, opts BlameOptions) (Contributions, error) {
+	var lines []blameLine
+	var err error
+	if opts.Backend == BackendGoGit {
+		lines, err = goGitBlame(ctx, path, opts)
+	} else {
+		lines, err = gitBlame(ctx, path, opts)
+	}
+	if err != nil {
+		return Contributions{}, err
+	}
+	if !opts.Since.IsZero() {
+		lines = linesSince(lines, opts.Since)
+	}
+	if opts.SinceCommit != "" {
+		lines = linesAfterBoundary(lines)
+	}
+	return countContributions(lines, opts.Metric), nil
+}
+
+// gitBlame runs git blame on path and returns the record of every line.
+func gitBlame(ctx context.Context, path string, opts BlameOptions) ([]blameLine, error) {
+	var args []string
+	if opts.MailmapFile != "" {
+		mailmap, err := filepath.Abs(opts.MailmapFile)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-c", "mailmap.file="+mailmap)
+	}
+	args = append(args, "blame", "--line-porcelain")
+	if opts.IgnoreWhitespace {
+		args = append(args, "-w")
+	}
+	if opts.DetectMoves {
+		args = append(args, "-M", "-C")
+	}
+	// Within a range, lines from before its start are attributed to
+	// boundary commits
+	switch {
+	case opts.SinceCommit != "":
+		args = append(args, opts.SinceCommit+".."+opts.Ref)
+	case opts.Ref != "":
+		args = append(args, opts.Ref)
+	}
+
+	// Run blame from the file's directory so it resolves against the
+	// repository containing the file rather than the working directory. At
+	// another revision that directory may not exist, so the closest one that
+	// does is used instead.
+	dir := existingDir(filepath.Dir(path))
+	relPath, err := filepath.Rel(dir, path)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, "--", relPath)
+
+	blame := exec.CommandContext(ctx, "git", args...)
+	blame.Dir = dir
+	output, err := blame.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+	return parseBlame(output)
+}
+
+// transientErrors are the parts of git error messages that mean a retry may
+// succeed: another git process holding a lock, or a passing I/O failure.
+var transientErrors = []string{
+	"index.lock",
+	".lock': File exists",
+	"Input/output error",
+	"Interrupted system call",
+}
+
+// isTransientError reports whether err from FileContributions looks likely
+// to pass on a retry. Errors such as a path outside the repository fail the
+// same way every time and aren't transient.
+func isTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := err.Error()
+	for _, transient := range transientErrors {
+		if strings.Contains(message, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// blameLine is the blame record for a single line of a file.
+type blameLine struct {
+	commit     string
+	authorName string
+	authorMail string
+	authorTime time.Time
+	// boundary is set for lines blamed to the start of a revision range
+	boundary bool
+}
+
+// parseBlame parses git blame --line-porcelain output, which repeats the
+// full commit header before every line of content.
+func parseBlame(output []byte) ([]blameLine, error) {
+	var lines []blameLine
+	var current blameLine
+	expectHeader := true
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(nil, maxBlameLine)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// Each record starts with "<sha> <orig line> <final line> [<count>]"
+		if expectHeader {
+			sha, _, _ := strings.Cut(line, " ")
+			current = blameLine{commit: sha}
+			expectHeader = false
+			continue
+		}
+
+		// Content lines are prefixed with a tab, may contain anything, and
+		// end the record
+		if strings.HasPrefix(line, "\t") {
+			lines = append(lines, current)
+			expectHeader = true
+			continue
+		}
+
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "author":
+			current.authorName = value
+		case "author-mail":
+			current.authorMail = strings.TrimSuffix(strings.TrimPrefix(value, "<"), ">")
+		case "author-time":
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid author-time %q", value)
+			}
+			current.authorTime = time.Unix(seconds, 0)
+		case "boundary":
+			current.boundary = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// linesAfterBoundary keeps the lines that weren't blamed to a boundary
+// commit.
+func linesAfterBoundary(lines []blameLine) []blameLine {
+	var kept []blameLine
+	for _, line := range lines {
+		if !line.boundary {
+			kept = append(kept, line)
+		}
+	}
+	return kept
+}
+
+// linesSince keeps the lines authored at or after since.
+func linesSince(lines []blameLine, since time.Time) []blameLine {
+	var kept []blameLine
+	for _, line := range lines {
+		if !line.authorTime.Before(since) {
+			kept = append(kept, line)
+		}
+	}
+	return kept
+}
+
+// uncommittedEmail is the author email git blame reports for lines that
+// haven't been committed yet.
+const uncommittedEmail = "not.committed.yet"
+
+// UncommittedAuthor is the author lines changed in the working tree but not
+// yet committed are attributed to.
+const UncommittedAuthor = "(uncommitted)"
+
+// countContributions totals blame records per author under metric.
+func countContributions(lines []blameLine, metric string) Contributions {
+	c := Contributions{
+		Counts:   make(map[string]int),
+		Names:    make(map[string]string),
+		LatestBy: make(map[string]time.Time),
+	}
+
+	if metric == MetricCommits {
+		c.Commits = make(map[string]map[string]bool)
+	}
+	for _, line := range lines {
+		if line.authorMail == "" {
+			continue
+		}
+		author := line.authorMail
+		if author == uncommittedEmail {
+			author = UncommittedAuthor
+		}
+		if c.Commits != nil {
+			if c.Commits[author][line.commit] {
+				continue
+			}
+			if c.Commits[author] == nil {
+				c.Commits[author] = make(map[string]bool)
+			}
+			c.Commits[author][line.commit] = true
+		}
+		c.Counts[author]++
+		c.Total++
+		if author == UncommittedAuthor {
+			continue
+		}
+		c.Names[line.authorMail] = line.authorName
+		if line.authorTime.After(c.Latest) {
+			c.Latest = line.authorTime
+		}
+		if line.authorTime.After(c.LatestBy[line.authorMail]) {
+			c.LatestBy[line.authorMail] = line.authorTime
+		}
+	}
+	return c
+}
+
+// StatLess reports whether author stat a should be listed before b.
+type StatLess func(a, b AuthorStat) bool
+
+// ByCount lists authors with the most lines first.
+func ByCount(a, b AuthorStat) bool {
+	return a.Count > b.Count
+}
+
+// ByEmail lists authors alphabetically by email.
+func ByEmail(a, b AuthorStat) bool {
+	return a.Email < b.Email
+}
+
+// ByPercentage lists authors with the largest share first.
+func ByPercentage(a, b AuthorStat) bool {
+	return a.Percentage > b.Percentage
+}
+
+// Reverse inverts the order of less.
+func Reverse(less StatLess) StatLess {
+	return func(a, b AuthorStat) bool {
+		return less(b, a)
+	}
+}
+
+// CalculateAndSortStats converts per-author line counts into stats ordered by
+// less, or by line count in descending order when less is nil. Authors that
+// less ranks equally are ordered by email, so the result doesn't depend on
+// map iteration order.
+func CalculateAndSortStats(authorCounts map[string]int, totalLines int, less StatLess) []AuthorStat {
+	if less == nil {
+		less = ByCount
+	}
+
+	var stats []AuthorStat
+	if totalLines > 0 {
+		for email, count := range authorCounts {
+			percentage := float64(count) / float64(totalLines) * 100
+			stats = append(stats, AuthorStat{
+				Email:      email,
+				Count:      count,
+				Percentage: percentage,
+			})
+		}
+
+		sort.Slice(stats, func(i, j int) bool {
+			a, b := stats[i], stats[j]
+			if less(a, b) != less(b, a) {
+				return less(a, b)
+			}
+			return a.Email < b.Email
+		})
+	}
+	return stats
+}
+
+// TopAuthors truncates stats to the first n authors, appending an Others
+// entry that sums the remainder. n of zero keeps every author.
+func TopAuthors(stats []AuthorStat, n int) []AuthorStat {
+	if n <= 0 || len(stats) <= n {
+		return stats
+	}
+
+	others := AuthorStat{Others: true}
+	for _, stat := range stats[n:] {
+		others.Count += stat.Count
+		others.Percentage += stat.Percentage
+	}
+	return append(stats[:n:n], others)
+}
+
+// FilterAuthors drops authors whose share is below threshold percent. When
+// keepOthers is set, the dropped authors are summed into an Others entry.
+func FilterAuthors(stats []AuthorStat, threshold float64, keepOthers bool) []AuthorStat {
+	if threshold <= 0 {
+		return stats
+	}
+
+	var kept []AuthorStat
+	others := AuthorStat{Others: true}
+	for _, stat := range stats {
+		if stat.Percentage >= threshold {
+			kept = append(kept, stat)
+			continue
+		}
+		others.Count += stat.Count
+		others.Percentage += stat.Percentage
+	}
+	if keepOthers && others.Count > 0 {
+		kept = append(kept, others)
+	}
+	return kept
+}
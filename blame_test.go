@@ -0,0 +1,335 @@
+package filetree
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckBackend(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    BlameOptions
+		wantErr string
+	}{
+		{"default", BlameOptions{}, ""},
+		{"git", BlameOptions{Backend: BackendGit, IgnoreWhitespace: true, DetectMoves: true}, ""},
+		{"unknown", BlameOptions{Backend: "svn"}, "unknown blame backend"},
+		{"go-git whitespace", BlameOptions{Backend: BackendGoGit, IgnoreWhitespace: true}, "ignoring whitespace"},
+		{"go-git mailmap", BlameOptions{Backend: BackendGoGit, MailmapFile: "m"}, "a mailmap file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckBackend(tt.opts)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("CheckBackend() = %v, want nil", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("CheckBackend() = %v, want an error mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+const porcelain = `aaaa000000000000000000000000000000000000 1 1 2
+author Alice
+author-mail <alice@x.org>
+author-time 1700000000
+author-tz +0000
+committer Alice
+committer-mail <alice@x.org>
+committer-time 1700000000
+committer-tz +0000
+summary first
+filename f.go
+	author-mail <mallory@x.org>
+aaaa000000000000000000000000000000000000 2 2
+author Alice
+author-mail <alice@x.org>
+author-time 1700000500
+author-tz +0000
+summary first
+filename f.go
+	
+bbbb000000000000000000000000000000000000 3 3 1
+author Bob Jones
+author-mail <bob@x.org>
+author-time 1600000000
+author-tz +0000
+summary base
+boundary
+filename f.go
+	author Eve
+`
+
+func TestParseBlame(t *testing.T) {
+	lines, err := parseBlame([]byte(porcelain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []blameLine{
+		{commit: "aaaa000000000000000000000000000000000000", authorName: "Alice", authorMail: "alice@x.org", authorTime: time.Unix(1700000000, 0)},
+		{commit: "aaaa000000000000000000000000000000000000", authorName: "Alice", authorMail: "alice@x.org", authorTime: time.Unix(1700000500, 0)},
+		{commit: "bbbb000000000000000000000000000000000000", authorName: "Bob Jones", authorMail: "bob@x.org", authorTime: time.Unix(1600000000, 0), boundary: true},
+	}
+	if !slices.Equal(lines, want) {
+		t.Errorf("parseBlame() = %+v, want %+v", lines, want)
+	}
+}
+
+func TestParseBlameErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+	}{
+		{"bad author-time", "aaaa 1 1 1\nauthor-time soon\n\tx\n"},
+		{"line too long", "aaaa 1 1 1\n\t" + strings.Repeat("x", maxBlameLine) + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseBlame([]byte(tt.output)); err == nil {
+				t.Error("parseBlame() succeeded, want an error")
+			}
+		})
+	}
+	if lines, err := parseBlame(nil); err != nil || len(lines) != 0 {
+		t.Errorf("empty output: %v, %v; want no lines", lines, err)
+	}
+}
+
+func TestCountContributions(t *testing.T) {
+	at := func(seconds int64) time.Time { return time.Unix(seconds, 0) }
+	lines := []blameLine{
+		{commit: "c1", authorName: "Alice", authorMail: "alice@x.org", authorTime: at(100)},
+		{commit: "c1", authorName: "Alice", authorMail: "alice@x.org", authorTime: at(100)},
+		{commit: "c2", authorName: "Alice", authorMail: "alice@x.org", authorTime: at(300)},
+		{commit: "c3", authorName: "Bob", authorMail: "bob@x.org", authorTime: at(200)},
+		{commit: "0000", authorName: "Not Committed Yet", authorMail: uncommittedEmail, authorTime: at(900)},
+		{commit: "c4"},
+	}
+	tests := []struct {
+		metric string
+		counts map[string]int
+		total  int
+	}{
+		{MetricLines, map[string]int{"alice@x.org": 3, "bob@x.org": 1, UncommittedAuthor: 1}, 5},
+		{"", map[string]int{"alice@x.org": 3, "bob@x.org": 1, UncommittedAuthor: 1}, 5},
+		{MetricCommits, map[string]int{"alice@x.org": 2, "bob@x.org": 1, UncommittedAuthor: 1}, 4},
+	}
+	for _, tt := range tests {
+		t.Run("metric "+tt.metric, func(t *testing.T) {
+			c := countContributions(lines, tt.metric)
+			if !maps.Equal(c.Counts, tt.counts) || c.Total != tt.total {
+				t.Errorf("counts %v, total %d; want %v, %d", c.Counts, c.Total, tt.counts, tt.total)
+			}
+			// Uncommitted lines carry no author time
+			if !c.Latest.Equal(at(300)) || !c.LatestBy["bob@x.org"].Equal(at(200)) {
+				t.Errorf("Latest %v, LatestBy %v", c.Latest, c.LatestBy)
+			}
+			if c.Names["bob@x.org"] != "Bob" {
+				t.Errorf("Names = %v", c.Names)
+			}
+		})
+	}
+}
+
+func TestLineFilters(t *testing.T) {
+	lines := []blameLine{
+		{commit: "old", authorTime: time.Unix(100, 0), boundary: true},
+		{commit: "mid", authorTime: time.Unix(200, 0)},
+		{commit: "new", authorTime: time.Unix(300, 0)},
+	}
+	commits := func(lines []blameLine) []string {
+		var names []string
+		for _, line := range lines {
+			names = append(names, line.commit)
+		}
+		return names
+	}
+	if got := commits(linesSince(lines, time.Unix(200, 0))); !slices.Equal(got, []string{"mid", "new"}) {
+		t.Errorf("linesSince = %v, want [mid new]", got)
+	}
+	if got := commits(linesAfterBoundary(lines)); !slices.Equal(got, []string{"mid", "new"}) {
+		t.Errorf("linesAfterBoundary = %v, want [mid new]", got)
+	}
+}
+
+func TestContributionsAddCommits(t *testing.T) {
+	// One commit touching both files counts once for the directory
+	a := countContributions([]blameLine{
+		{commit: "c1", authorMail: "alice@x.org"},
+		{commit: "c2", authorMail: "alice@x.org"},
+	}, MetricCommits)
+	b := countContributions([]blameLine{
+		{commit: "c1", authorMail: "alice@x.org"},
+		{commit: "c3", authorMail: "bob@x.org"},
+	}, MetricCommits)
+	var dir Contributions
+	dir.Add(a)
+	dir.Add(b)
+	if want := map[string]int{"alice@x.org": 2, "bob@x.org": 1}; !maps.Equal(dir.Counts, want) || dir.Total != 3 {
+		t.Errorf("counts %v, total %d; want %v, 3", dir.Counts, dir.Total, want)
+	}
+	if a.Counts["alice@x.org"] != 2 || len(a.Commits["alice@x.org"]) != 2 {
+		t.Errorf("Add modified its argument: %v", a.Commits)
+	}
+}
+
+func TestCalculateAndSortStats(t *testing.T) {
+	counts := map[string]int{"carol@x.org": 2, "alice@x.org": 5, "bob@x.org": 2, "dave@x.org": 1}
+	tests := []struct {
+		name string
+		less StatLess
+		want []string
+	}{
+		{"default", nil, []string{"alice@x.org", "bob@x.org", "carol@x.org", "dave@x.org"}},
+		{"count", ByCount, []string{"alice@x.org", "bob@x.org", "carol@x.org", "dave@x.org"}},
+		{"email", ByEmail, []string{"alice@x.org", "bob@x.org", "carol@x.org", "dave@x.org"}},
+		{"percentage", ByPercentage, []string{"alice@x.org", "bob@x.org", "carol@x.org", "dave@x.org"}},
+		{"reverse count", Reverse(ByCount), []string{"dave@x.org", "bob@x.org", "carol@x.org", "alice@x.org"}},
+		{"reverse email", Reverse(ByEmail), []string{"dave@x.org", "carol@x.org", "bob@x.org", "alice@x.org"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Ties are broken by email whatever order the map yields
+			for range 20 {
+				stats := CalculateAndSortStats(counts, 10, tt.less)
+				var emails []string
+				for _, stat := range stats {
+					emails = append(emails, stat.Email)
+				}
+				if !slices.Equal(emails, tt.want) {
+					t.Fatalf("order %v, want %v", emails, tt.want)
+				}
+				if stats[0].Count+stats[1].Count+stats[2].Count+stats[3].Count != 10 {
+					t.Fatalf("counts %+v", stats)
+				}
+			}
+		})
+	}
+
+	stats := CalculateAndSortStats(map[string]int{"a": 1, "b": 3}, 4, nil)
+	if stats[0].Percentage != 75 || stats[1].Percentage != 25 {
+		t.Errorf("percentages %+v, want 75 and 25", stats)
+	}
+	if stats := CalculateAndSortStats(map[string]int{"a": 1}, 0, nil); stats != nil {
+		t.Errorf("zero total: %+v, want no stats", stats)
+	}
+}
+
+func TestTopAuthors(t *testing.T) {
+	stats := []AuthorStat{
+		{Email: "a", Count: 6, Percentage: 60},
+		{Email: "b", Count: 3, Percentage: 30},
+		{Email: "c", Count: 1, Percentage: 10},
+	}
+	tests := []struct {
+		name string
+		got  []AuthorStat
+		want []AuthorStat
+	}{
+		{"top all", TopAuthors(slices.Clone(stats), 0), stats},
+		{"top more than there are", TopAuthors(slices.Clone(stats), 5), stats},
+		{"top one", TopAuthors(slices.Clone(stats), 1), []AuthorStat{stats[0], {Count: 4, Percentage: 40, Others: true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !slices.Equal(tt.got, tt.want) {
+				t.Errorf("got %+v, want %+v", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterAuthors(t *testing.T) {
+	stats := []AuthorStat{
+		{Email: "a", Count: 6, Percentage: 60},
+		{Email: "b", Count: 3, Percentage: 30},
+		{Email: "c", Count: 1, Percentage: 10},
+	}
+	tests := []struct {
+		name string
+		got  []AuthorStat
+		want []AuthorStat
+	}{
+		{"no threshold", FilterAuthors(slices.Clone(stats), 0, true), stats},
+		{"threshold", FilterAuthors(slices.Clone(stats), 30, false), stats[:2]},
+		{"threshold with others", FilterAuthors(slices.Clone(stats), 30, true), []AuthorStat{stats[0], stats[1], {Count: 1, Percentage: 10, Others: true}}},
+		{"threshold above all", FilterAuthors(slices.Clone(stats), 90, false), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !slices.Equal(tt.got, tt.want) {
+				t.Errorf("got %+v, want %+v", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("exit status 128: fatal: Unable to create '/r/.git/index.lock': File exists."), true},
+		{errors.New("error: cannot lock ref 'HEAD': '/r/.git/HEAD.lock': File exists"), true},
+		{errors.New("read /r/f: Input/output error"), true},
+		{errors.New("exit status 128: fatal: no such path 'f' in HEAD"), false},
+		{errors.New("exit status 128: fatal: not a git repository"), false},
+	}
+	for _, tt := range tests {
+		if got := isTransientError(tt.err); got != tt.want {
+			t.Errorf("isTransientError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestFileContributions(t *testing.T) {
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	repo := newTestRepo(t)
+	repo.commitAt("alice@x.org", old, map[string]string{"my file.go": "a\nb\n", "indent.go": "func f() {\nreturn\n}\n"})
+	repo.git("tag", "v1")
+	repo.commit("bob@x.org", map[string]string{"my file.go": "a\nb\nc\n", "indent.go": "func f() {\n\treturn\n}\n"})
+	repo.commit("alice2@x.org", map[string]string{"my file.go": "a\nb\nc\nd\n"})
+	mailmap := filepath.Join(t.TempDir(), "mailmap")
+	os.WriteFile(mailmap, []byte("Alice <alice@x.org> <alice2@x.org>\n"), 0o644)
+	repo.write("my file.go", "a\nb\nc\nd\ne\n")
+
+	tests := []struct {
+		name string
+		file string
+		opts BlameOptions
+		want map[string]int
+	}{
+		{"space in name", "my file.go", BlameOptions{}, map[string]int{"alice@x.org": 2, "bob@x.org": 1, "alice2@x.org": 1, UncommittedAuthor: 1}},
+		{"commits", "my file.go", BlameOptions{Metric: MetricCommits}, map[string]int{"alice@x.org": 1, "bob@x.org": 1, "alice2@x.org": 1, UncommittedAuthor: 1}},
+		{"mailmap", "my file.go", BlameOptions{MailmapFile: mailmap}, map[string]int{"alice@x.org": 3, "bob@x.org": 1, UncommittedAuthor: 1}},
+		{"since", "my file.go", BlameOptions{Since: old.AddDate(0, 0, 1)}, map[string]int{"bob@x.org": 1, "alice2@x.org": 1, UncommittedAuthor: 1}},
+		{"ref", "my file.go", BlameOptions{Ref: "v1"}, map[string]int{"alice@x.org": 2}},
+		{"since commit", "my file.go", BlameOptions{SinceCommit: "v1"}, map[string]int{"bob@x.org": 1, "alice2@x.org": 1}},
+		{"whitespace", "indent.go", BlameOptions{}, map[string]int{"alice@x.org": 2, "bob@x.org": 1}},
+		{"ignore whitespace", "indent.go", BlameOptions{IgnoreWhitespace: true}, map[string]int{"alice@x.org": 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := FileContributions(context.Background(), filepath.Join(repo.dir, tt.file), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(c.Counts, tt.want) {
+				t.Errorf("counts %v, want %v", c.Counts, tt.want)
+			}
+		})
+	}
+
+	if _, err := FileContributions(context.Background(), filepath.Join(repo.dir, "missing.go"), BlameOptions{}); err == nil {
+		t.Error("blaming a missing file succeeded")
+	}
+}
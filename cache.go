@@ -0,0 +1,278 @@
+package filetree
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheVersion names the directory entries are stored under, so entries
+// written in an older format are never read.
+const cacheVersion = 5
+
+// keptStates is how many repository states, most recently used first, keep
+// their entries. Every commit moves HEAD to a new state, so the entries of
+// older ones are removed rather than left behind for good, while a few are
+// kept for runs that alternate, such as with and without --ref.
+const keptStates = 3
+
+// DefaultCacheDir returns the directory blame results are cached in by
+// default, under the user's cache directory.
+func DefaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "filetree"), nil
+}
+
+// cacheEntry is the on-disk form of one file's cached blame result.
+type cacheEntry struct {
+	// Blob is the git blob sha of the file content that was blamed
+	Blob    string        `json:"blob"`
+	Contrib Contributions `json:"contributions"`
+}
+
+// blameCache stores blame results under dir, one entry per file, set of
+// blame options and repository state, in a directory per repository and
+// state. An entry is reused only while the file's blob sha matches the one
+// it was blamed at.
+type blameCache struct {
+	dir string
+
+	mu sync.Mutex
+	// states memoizes stateDir by the directory blame runs in
+	states map[string]string
+}
+
+// cachedContributions returns the cached blame result for path if its
+// content, the commit it is blamed from and the mailmaps are unchanged, and
+// otherwise blames it and updates the cache. blob is the file's blob sha if
+// already known, as it is when blaming another revision; otherwise it is
+// computed from the file on disk, or taken from HEAD when blaming a range,
+// which stops at HEAD. A cache that can't be read or written falls back to
+// running git blame.
+func (c *blameCache) cachedContributions(ctx context.Context, path, blob string, opts BlameOptions) (Contributions, error) {
+	stateDir, err := c.stateDir(existingDir(filepath.Dir(path)), opts)
+	if err != nil {
+		return FileContributions(ctx, path, opts)
+	}
+	if blob == "" {
+		if opts.SinceCommit != "" {
+			blob, err = committedBlob(path, "HEAD")
+		} else {
+			blob, err = blobHash(path)
+		}
+		if err != nil {
+			return FileContributions(ctx, path, opts)
+		}
+	}
+	entryPath := c.entryPath(stateDir, path, opts)
+
+	if data, err := os.ReadFile(entryPath); err == nil {
+		var entry cacheEntry
+		if json.Unmarshal(data, &entry) == nil && entry.Blob == blob {
+			return entry.Contrib, nil
+		}
+	}
+
+	contrib, err := FileContributions(ctx, path, opts)
+	if err != nil {
+		return contrib, err
+	}
+	// Uncommitted lines are reattributed once they're committed, without
+	// the content changing, so their results can't be reused
+	if _, ok := contrib.Counts[UncommittedAuthor]; !ok {
+		c.store(entryPath, cacheEntry{Blob: blob, Contrib: contrib})
+	}
+	return contrib, nil
+}
+
+// entryPath returns where the entry for path blamed with opts is stored in
+// the directory of its repository state.
+func (c *blameCache) entryPath(stateDir, path string, opts BlameOptions) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%+v", path, opts)))
+	return filepath.Join(stateDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// stateDir returns the directory holding the entries for files in dir in
+// the current state of their repository, as hashed by repoState. The first
+// time a repository is seen, the entries of all but its most recently used
+// states are removed.
+func (c *blameCache) stateDir(dir string, opts BlameOptions) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stateDir, ok := c.states[dir]; ok {
+		return stateDir, nil
+	}
+	toplevel, state, err := repoState(dir, opts)
+	if err != nil {
+		return "", err
+	}
+	repoSum := sha256.Sum256([]byte(toplevel))
+	repoDir := filepath.Join(c.dir, fmt.Sprintf("v%d", cacheVersion), hex.EncodeToString(repoSum[:]))
+	stateDir := filepath.Join(repoDir, state)
+	if os.MkdirAll(stateDir, 0o755) == nil {
+		// The directory's modification time records when its state was
+		// last used
+		now := time.Now()
+		os.Chtimes(stateDir, now, now)
+		pruneStates(repoDir)
+	}
+
+	if c.states == nil {
+		c.states = make(map[string]string)
+	}
+	c.states[dir] = stateDir
+	return stateDir, nil
+}
+
+// pruneStates removes the state directories under repoDir beyond the
+// keptStates most recently used.
+func pruneStates(repoDir string) {
+	entries, err := os.ReadDir(repoDir)
+	if err != nil {
+		return
+	}
+	type state struct {
+		name string
+		used time.Time
+	}
+	var states []state
+	for _, entry := range entries {
+		if fileInfo, err := entry.Info(); err == nil && entry.IsDir() {
+			states = append(states, state{entry.Name(), fileInfo.ModTime()})
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].used.After(states[j].used)
+	})
+	for _, state := range states[min(len(states), keptStates):] {
+		os.RemoveAll(filepath.Join(repoDir, state.name))
+	}
+}
+
+// repoState returns the root of the repository containing dir and a hash of
+// what a blame result for a file in it depends on besides the file itself
+// and opts: the commit blamed from, which changes when history is rewritten,
+// and the content of every mailmap that maps authors.
+func repoState(dir string, opts BlameOptions) (toplevel, state string, err error) {
+	rev := opts.Ref
+	if rev == "" {
+		rev = "HEAD"
+	}
+	output, err := gitOutput(dir, "rev-parse", "--show-toplevel", rev+"^{commit}")
+	if err != nil {
+		return "", "", err
+	}
+	toplevel, commit, _ := strings.Cut(strings.TrimSpace(output), "\n")
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00", commit)
+	// The repository's own .mailmap comes first; mailmap.file and then
+	// mailmap.blob, or the --mailmap file standing in for mailmap.file,
+	// are read after it
+	hashFile(h, filepath.Join(toplevel, ".mailmap"))
+	config, _ := gitOutput(dir, "config", "--get-regexp", `^mailmap\.`)
+	for _, line := range strings.Split(strings.TrimSpace(config), "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch strings.ToLower(key) {
+		case "mailmap.file":
+			if path, err := expandHome(value); err == nil {
+				hashFile(h, path)
+			}
+		case "mailmap.blob":
+			blob, _ := gitOutput(dir, "rev-parse", "--verify", "--quiet", value)
+			fmt.Fprintf(h, "%s\x00", strings.TrimSpace(blob))
+		}
+	}
+	if opts.MailmapFile != "" {
+		hashFile(h, opts.MailmapFile)
+	}
+
+	return toplevel, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile writes the content of the file at path to h, terminated so that
+// consecutive files can't run together. A missing file hashes as empty.
+func hashFile(h io.Writer, path string) {
+	if data, err := os.ReadFile(path); err == nil {
+		h.Write(data)
+	}
+	h.Write([]byte{0})
+}
+
+// committedBlob returns the blob sha of the file at path as of rev.
+func committedBlob(path, rev string) (string, error) {
+	dir := filepath.Dir(path)
+	output, err := gitOutput(dir, "rev-parse", "--verify", "--quiet", rev+":./"+filepath.ToSlash(filepath.Base(path)))
+	return strings.TrimSpace(output), err
+}
+
+// gitOutput runs git with args in dir and returns its standard output.
+func gitOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	return string(output), err
+}
+
+// store writes entry to entryPath, replacing it atomically so concurrent runs
+// never read a partial entry. Failures are ignored; the file is simply
+// blamed again next time.
+func (c *blameCache) store(entryPath string, entry cacheEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(entryPath), 0o755); err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(entryPath), "entry-*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	if err := os.Rename(tmp.Name(), entryPath); err != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+// blobHash returns the git blob sha of the file at path, as computed by git
+// hash-object without any content filters.
+func blobHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", fileInfo.Size())
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
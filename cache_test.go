@@ -0,0 +1,178 @@
+package filetree
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// countBlames puts a wrapper around git first on PATH that logs every
+// invocation, and returns a function counting the git blame calls so far.
+func countBlames(t *testing.T) func() int {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the git wrapper is a shell script")
+	}
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found")
+	}
+	bin := t.TempDir()
+	log := filepath.Join(bin, "calls")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$*\" >> %q\nexec %q \"$@\"\n", log, realGit)
+	if err := os.WriteFile(filepath.Join(bin, "git"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	return func() int {
+		data, _ := os.ReadFile(log)
+		blames := 0
+		for _, call := range strings.Split(string(data), "\n") {
+			if strings.Contains(" "+call+" ", " blame ") {
+				blames++
+			}
+		}
+		return blames
+	}
+}
+
+// rootEmails walks dir with opts and returns the root's author emails.
+func rootEmails(t *testing.T, dir string, opts Options) []string {
+	t.Helper()
+	tree, err := Walk(context.Background(), dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var emails []string
+	for _, stat := range tree.Authors {
+		emails = append(emails, stat.Email)
+	}
+	return emails
+}
+
+func TestCacheSecondRunIssuesNoBlame(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.commit("alice@x.org", map[string]string{"a.go": "a\n", "dir/b.go": "b\n"})
+	blames := countBlames(t)
+
+	opts := Options{CacheDir: t.TempDir()}
+	rootEmails(t, repo.dir, opts)
+	if got := blames(); got != 2 {
+		t.Fatalf("first run: %d blame calls, want 2", got)
+	}
+	rootEmails(t, repo.dir, opts)
+	if got := blames(); got != 2 {
+		t.Errorf("second run: %d more blame calls, want none", got-2)
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   func(dir string) Options
+		change func(r *testRepo, dir string)
+		want   string
+	}{
+		{
+			name: "committed mailmap",
+			change: func(r *testRepo, _ string) {
+				r.commit("bob@x.org", map[string]string{".mailmap": "alice <alice@x.org> <bob@x.org>\n"})
+			},
+			want: "alice@x.org",
+		},
+		{
+			name: "edited mailmap file",
+			opts: func(dir string) Options {
+				return Options{Blame: BlameOptions{MailmapFile: filepath.Join(dir, "mailmap")}}
+			},
+			change: func(_ *testRepo, dir string) {
+				os.WriteFile(filepath.Join(dir, "mailmap"), []byte("alice <alice@x.org> <bob@x.org>\n"), 0o644)
+			},
+			want: "alice@x.org",
+		},
+		{
+			name: "rewritten history",
+			change: func(r *testRepo, _ string) {
+				r.git("-c", "user.name=carol", "-c", "user.email=carol@x.org", "commit", "-q", "--amend", "--reset-author", "--no-edit")
+			},
+			want: "alice@x.org,carol@x.org",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newTestRepo(t)
+			repo.commit("alice@x.org", map[string]string{"f.go": "a\n"})
+			repo.commit("bob@x.org", map[string]string{"f.go": "a\nb\n"})
+			outside := t.TempDir()
+			os.WriteFile(filepath.Join(outside, "mailmap"), nil, 0o644)
+
+			opts := Options{}
+			if tt.opts != nil {
+				opts = tt.opts(outside)
+			}
+			opts.CacheDir = t.TempDir()
+			if got := strings.Join(rootEmails(t, repo.dir, opts), ","); got != "alice@x.org,bob@x.org" {
+				t.Fatalf("before: authors %s", got)
+			}
+			tt.change(repo, outside)
+			if got := strings.Join(rootEmails(t, repo.dir, opts), ","); got != tt.want {
+				t.Errorf("after: authors %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheSinceCommitFollowsHead(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.commit("alice@x.org", map[string]string{"top.go": "a\n"})
+	repo.git("tag", "v1")
+	repo.commit("carol@x.org", map[string]string{"top.go": "a\nc\n"})
+
+	opts := Options{CacheDir: t.TempDir()}
+	opts.Blame.SinceCommit = strings.TrimSpace(repo.git("rev-parse", "v1"))
+	if got := strings.Join(rootEmails(t, repo.dir, opts), ","); got != "carol@x.org" {
+		t.Fatalf("before: authors %s, want carol@x.org", got)
+	}
+
+	// The same content committed again by someone else leaves the file's
+	// blob unchanged
+	repo.git("reset", "-q", "--hard", "v1")
+	repo.commit("dave@x.org", map[string]string{"top.go": "a\nc\n"})
+	if got := strings.Join(rootEmails(t, repo.dir, opts), ","); got != "dave@x.org" {
+		t.Errorf("after: authors %s, want dave@x.org", got)
+	}
+}
+
+func TestCachePrunesOldStates(t *testing.T) {
+	repo := newTestRepo(t)
+	cacheDir := t.TempDir()
+	opts := Options{CacheDir: cacheDir}
+	for i := range keptStates + 2 {
+		repo.commit("alice@x.org", map[string]string{"a.go": "a\n", fmt.Sprintf("f%d.go", i): "f\n"})
+		rootEmails(t, repo.dir, opts)
+	}
+
+	// Every commit is a new state, but only the latest ones keep entries
+	states, err := filepath.Glob(filepath.Join(cacheDir, "*", "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != keptStates {
+		t.Fatalf("%d state directories, want %d: %q", len(states), keptStates, states)
+	}
+	// The state after commit i has i+2 files
+	want := 0
+	for i := 2; i < keptStates+2; i++ {
+		want += i + 2
+	}
+	entries, _ := filepath.Glob(filepath.Join(cacheDir, "*", "*", "*", "*.json"))
+	if len(entries) != want {
+		t.Errorf("%d entries, want %d", len(entries), want)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// shells lists the shells completion scripts can be generated for.
+var shells = []string{"bash", "zsh", "fish"}
+
+// completionFlag is a command line flag as offered by shell completion.
+type completionFlag struct {
+	// name is the flag as typed, e.g. "--depth" or "-d"
+	name  string
+	usage string
+	// takesValue is false for boolean flags
+	takesValue bool
+}
+
+// completionFlags returns every flag defined on the command line, in name
+// order.
+func completionFlags() []completionFlag {
+	var flags []completionFlag
+	flag.VisitAll(func(f *flag.Flag) {
+		name := "--" + f.Name
+		if len(f.Name) == 1 {
+			name = "-" + f.Name
+		}
+		boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool })
+		flags = append(flags, completionFlag{name: name, usage: f.Usage, takesValue: !ok || !boolFlag.IsBoolFlag()})
+	})
+	return flags
+}
+
+// writeCompletion writes the completion script for shell to w.
+func writeCompletion(w io.Writer, shell string) error {
+	switch shell {
+	case "bash":
+		writeBashCompletion(w, completionFlags())
+	case "zsh":
+		writeZshCompletion(w, completionFlags())
+	case "fish":
+		writeFishCompletion(w, completionFlags())
+	default:
+		return fmt.Errorf("unsupported shell %q (want %s)", shell, strings.Join(shells, ", "))
+	}
+	return nil
+}
+
+func writeBashCompletion(w io.Writer, flags []completionFlag) {
+	names := make([]string, len(flags))
+	for i, f := range flags {
+		names[i] = f.name
+	}
+
+	fmt.Fprintf(w, `# bash completion for filetree
+_filetree() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    if [[ "$cur" == -* ]]; then
+        COMPREPLY=($(compgen -W "%s" -- "$cur"))
+    elif [[ $COMP_CWORD -eq 2 && "${COMP_WORDS[1]}" == completion ]]; then
+        COMPREPLY=($(compgen -W "%s" -- "$cur"))
+    elif [[ $COMP_CWORD -eq 1 ]]; then
+        COMPREPLY=($(compgen -W "completion" -- "$cur") $(compgen -d -- "$cur"))
+    else
+        COMPREPLY=($(compgen -d -- "$cur"))
+    fi
+}
+complete -o filenames -F _filetree filetree
+`, strings.Join(names, " "), strings.Join(shells, " "))
+}
+
+func writeZshCompletion(w io.Writer, flags []completionFlag) {
+	fmt.Fprintln(w, "#compdef filetree")
+	fmt.Fprintln(w, "_arguments \\")
+	for _, f := range flags {
+		spec := f.name + "[" + zshEscape(f.usage) + "]"
+		if f.takesValue {
+			spec += ":value:"
+		}
+		fmt.Fprintf(w, "  %s \\\n", shellQuote(spec))
+	}
+	fmt.Fprintf(w, "  %s \\\n", shellQuote(`1:directory or command:{_alternative "commands:command:(completion)" "directories:directory:_directories"}`))
+	fmt.Fprintf(w, "  %s\n", shellQuote("2:shell:("+strings.Join(shells, " ")+")"))
+}
+
+func writeFishCompletion(w io.Writer, flags []completionFlag) {
+	fmt.Fprintln(w, "# fish completion for filetree")
+	fmt.Fprintln(w, "complete -c filetree -f -n __fish_use_subcommand -a completion -d 'Print a shell completion script'")
+	fmt.Fprintf(w, "complete -c filetree -f -n '__fish_seen_subcommand_from completion' -a '%s'\n", strings.Join(shells, " "))
+	fmt.Fprintln(w, "complete -c filetree -f -a '(__fish_complete_directories)'")
+	for _, f := range flags {
+		option := "-l " + strings.TrimPrefix(f.name, "--")
+		if !strings.HasPrefix(f.name, "--") {
+			option = "-s " + strings.TrimPrefix(f.name, "-")
+		}
+		if f.takesValue {
+			option += " -r"
+		}
+		fmt.Fprintf(w, "complete -c filetree %s -d %s\n", option, shellQuote(f.usage))
+	}
+}
+
+// zshEscape escapes the characters _arguments treats specially in an option
+// description.
+func zshEscape(s string) string {
+	return strings.NewReplacer("[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+}
+
+// shellQuote wraps s in single quotes for a POSIX-style shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -2,223 +2,748 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
-	"sort"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+
+	"filetree"
+)
+
+// Build information, set at build time with -ldflags "-X main.version=...".
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
 )
 
+const colorReset = "\033[0m"
+
+// The default ownership colors, as xterm 256-color palette indexes.
 const (
-	colorReset      = "\033[0m"
-	colorPink       = "\033[38;5;205m"
-	colorGreen      = "\033[32m"
-	colorLightGreen = "\033[38;5;118m"
-	colorYellow     = "\033[33m"
-	colorTeal       = "\033[38;5;51m"
+	colorPink       = 205
+	colorGreen      = 2
+	colorLightGreen = 118
+	colorYellow     = 3
+	colorTeal       = 51
 )
 
-func loadGitignore(path string) ([]string, error) {
-	var patterns []string
+// colorNames maps the color names accepted in color rules to palette indexes.
+var colorNames = map[string]int{
+	"red":        1,
+	"green":      colorGreen,
+	"yellow":     colorYellow,
+	"blue":       4,
+	"magenta":    5,
+	"cyan":       6,
+	"white":      7,
+	"pink":       colorPink,
+	"lightgreen": colorLightGreen,
+	"teal":       colorTeal,
+}
+
+// termColor is either a 256-color palette index or, with trueColor set, a
+// 24-bit color.
+type termColor struct {
+	palette   int
+	trueColor bool
+	r, g, b   uint8
+}
 
-	file, err := os.Open(path)
-	if err != nil {
-		// Return an empty slice if .gitignore doesn't exist
-		if os.IsNotExist(err) {
-			return patterns, nil
+// ansi returns the escape sequence selecting c.
+func (c termColor) ansi() string {
+	if c.trueColor {
+		return fmt.Sprintf("\033[38;2;%d;%d;%dm", c.r, c.g, c.b)
+	}
+	return ansiColor(c.palette)
+}
+
+// hex returns c as an RGB hex string.
+func (c termColor) hex() string {
+	if c.trueColor {
+		return fmt.Sprintf("#%02x%02x%02x", c.r, c.g, c.b)
+	}
+	return hexColor(c.palette)
+}
+
+// colorRule colors the percentages above a threshold.
+type colorRule struct {
+	above float64
+	color termColor
+}
+
+// defaultTheme names the built-in ownership colors.
+const defaultTheme = "default"
+
+// defaultColorRules are the ownership colors used unless .filetree.toml sets
+// color_rules or another theme is selected.
+var defaultColorRules = []colorRule{
+	{above: 75, color: termColor{palette: colorPink}},
+	{above: 60, color: termColor{palette: colorGreen}},
+	{above: 50, color: termColor{palette: colorLightGreen}},
+	{above: 25, color: termColor{palette: colorYellow}},
+	{above: 0, color: termColor{palette: colorTeal}},
+}
+
+// parseColorRules converts configured color rules, whose colors are names,
+// 256-color palette numbers or "#rrggbb" truecolor codes.
+func parseColorRules(rules []filetree.ColorRule) ([]colorRule, error) {
+	parsed := make([]colorRule, 0, len(rules))
+	for _, rule := range rules {
+		color, err := parseColor(rule.Color)
+		if err != nil {
+			return nil, err
 		}
-		return nil, err
+		parsed = append(parsed, colorRule{above: rule.Above, color: color})
 	}
-	defer file.Close()
+	return parsed, nil
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line != "" && !strings.HasPrefix(line, "#") {
-			patterns = append(patterns, line)
+// parseColor parses a color name, 256-color palette number or "#rrggbb"
+// code.
+func parseColor(s string) (termColor, error) {
+	if n, ok := colorNames[s]; ok {
+		return termColor{palette: n}, nil
+	}
+	if hex, ok := strings.CutPrefix(s, "#"); ok && len(hex) == 6 {
+		if rgb, err := strconv.ParseUint(hex, 16, 32); err == nil {
+			return termColor{trueColor: true, r: uint8(rgb >> 16), g: uint8(rgb >> 8), b: uint8(rgb)}, nil
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > 255 {
+		return termColor{}, fmt.Errorf("invalid color %q (want a color name, 0-255 or #rrggbb)", s)
 	}
-	return patterns, nil
+	return termColor{palette: n}, nil
 }
 
-func loadIgnorePatterns(dir string) ([]string, error) {
-	var allPatterns []string
+// themeNames returns the themes --theme accepts: the default and those in
+// cfg, in name order.
+func themeNames(cfg *filetree.Config) []string {
+	names := []string{defaultTheme}
+	for name := range cfg.Themes {
+		if name != defaultTheme {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names[1:])
+	return names
+}
 
-	// Load .gitignore patterns
-	gitignorePath := filepath.Join(dir, ".gitignore")
-	gitPatterns, err := loadGitignore(gitignorePath)
-	if err != nil {
-		return nil, fmt.Errorf("error loading .gitignore: %v", err)
+// ruleColor returns the color of the first rule percentage exceeds.
+func ruleColor(percentage float64, rules []colorRule) (termColor, bool) {
+	for _, rule := range rules {
+		if percentage > rule.above {
+			return rule.color, true
+		}
+	}
+	return termColor{}, false
+}
+
+// ansiColor returns the escape sequence selecting palette color n, using the
+// basic sequences for the first eight colors.
+func ansiColor(n int) string {
+	if n < 8 {
+		return fmt.Sprintf("\033[3%dm", n)
+	}
+	return fmt.Sprintf("\033[38;5;%dm", n)
+}
+
+// hexColor returns palette color n as an RGB hex string, e.g. "#ff5faf".
+func hexColor(n int) string {
+	var r, g, b int
+	switch {
+	case n < 16:
+		// The system colors, as xterm defines them
+		system := [16][3]int{
+			{0x00, 0x00, 0x00}, {0x80, 0x00, 0x00}, {0x00, 0x80, 0x00}, {0x80, 0x80, 0x00},
+			{0x00, 0x00, 0x80}, {0x80, 0x00, 0x80}, {0x00, 0x80, 0x80}, {0xc0, 0xc0, 0xc0},
+			{0x80, 0x80, 0x80}, {0xff, 0x00, 0x00}, {0x00, 0xff, 0x00}, {0xff, 0xff, 0x00},
+			{0x00, 0x00, 0xff}, {0xff, 0x00, 0xff}, {0x00, 0xff, 0xff}, {0xff, 0xff, 0xff},
+		}
+		r, g, b = system[n][0], system[n][1], system[n][2]
+	case n < 232:
+		// A 6x6x6 color cube
+		levels := [6]int{0x00, 0x5f, 0x87, 0xaf, 0xd7, 0xff}
+		n -= 16
+		r, g, b = levels[n/36], levels[n/6%6], levels[n%6]
+	default:
+		// A grayscale ramp
+		r = 8 + (n-232)*10
+		g, b = r, r
+	}
+	return fmt.Sprintf("#%02x%02x%02x", r, g, b)
+}
+
+// colorEnabled resolves a --color mode to whether output should be colored.
+// In "auto" mode, NO_COLOR must be unset or empty and stdout must be a
+// terminal.
+func colorEnabled(mode string) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+	default:
+		return false, fmt.Errorf("invalid color mode %q (want auto, always or never)", mode)
+	}
+
+	if os.Getenv("NO_COLOR") != "" {
+		return false, nil
 	}
-	allPatterns = append(allPatterns, gitPatterns...)
+	return isTerminal(os.Stdout), nil
+}
 
-	// Load .filetree.toml patterns
-	filetreeIgnorePath := filepath.Join(dir, ".filetree.toml")
-	filetreePatterns, err := loadGitignore(filetreeIgnorePath)
+// isTerminal reports whether file is a terminal.
+func isTerminal(file *os.File) bool {
+	fileInfo, err := file.Stat()
 	if err != nil {
-		return nil, fmt.Errorf("error loading .filetree.toml: %v", err)
+		return false
 	}
-	allPatterns = append(allPatterns, filetreePatterns...)
+	return fileInfo.Mode()&os.ModeCharDevice != 0
+}
 
-	return allPatterns, nil
+// printProgress shows how many files have been blamed on stderr, rewriting
+// the same line and clearing it once every file is done.
+func printProgress(done, total int) {
+	if done == total {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\rBlaming files: %d/%d", done, total)
+}
+
+// gradientColor returns the truecolor shade for percentage on a gradient
+// running from red at 0% through yellow at 50% to green at 100%.
+func gradientColor(percentage float64) termColor {
+	t := min(max(percentage/100, 0), 1)
+	if t < 0.5 {
+		return termColor{trueColor: true, r: 255, g: uint8(math.Round(510 * t))}
+	}
+	return termColor{trueColor: true, r: uint8(math.Round(510 * (1 - t))), g: 255}
+}
+
+// trueColorSupported reports whether the terminal advertises 24-bit color
+// through COLORTERM.
+func trueColorSupported() bool {
+	colorTerm := os.Getenv("COLORTERM")
+	return colorTerm == "truecolor" || colorTerm == "24bit"
+}
+
+// getPercentageColor returns the color of percentage on the gradient, if
+// enabled, or else of the first rule it exceeds.
+func getPercentageColor(percentage float64, opts renderOptions) string {
+	if !opts.color {
+		return ""
+	}
+	if opts.gradient {
+		return gradientColor(percentage).ansi()
+	}
+	if color, ok := ruleColor(percentage, opts.colorRules); ok {
+		return color.ansi()
+	}
+	return colorReset
+}
+
+func getResetColor(useColor bool) string {
+	if !useColor {
+		return ""
+	}
+	return colorReset
+}
+
+// formatPercentage renders a percentage wrapped in its ownership color.
+func formatPercentage(percentage float64, opts renderOptions) string {
+	return fmt.Sprintf("%s%.1f%%%s", getPercentageColor(percentage, opts), percentage, getResetColor(opts.color))
+}
+
+// glyphs is the set of connector strings used to draw the tree.
+type glyphs struct {
+	branch     string
+	lastBranch string
+	vertical   string
+	blank      string
+	// barFull and barEmpty draw the filled and unfilled parts of a share
+	// bar
+	barFull  string
+	barEmpty string
+}
+
+var (
+	unicodeGlyphs = glyphs{branch: "├── ", lastBranch: "└── ", vertical: "│   ", blank: "    ", barFull: "█", barEmpty: "░"}
+	asciiGlyphs   = glyphs{branch: "|-- ", lastBranch: "`-- ", vertical: "|   ", blank: "    ", barFull: "#", barEmpty: "-"}
+)
+
+// defaultGlyphs returns the glyphs to draw with on goos, given its
+// environment, when neither --ascii nor --utf8 is set. Windows consoles often
+// use a legacy code page that garbles box characters, except for Windows
+// Terminal, which sets WT_SESSION.
+func defaultGlyphs(goos string, getenv func(string) string) glyphs {
+	if goos == "windows" && getenv("WT_SESSION") == "" {
+		return asciiGlyphs
+	}
+	return unicodeGlyphs
+}
+
+// connector returns the branch glyph drawn in front of a tree node.
+func (g glyphs) connector(isLast bool) string {
+	if isLast {
+		return g.lastBranch
+	}
+	return g.branch
+}
+
+// continuation returns the indentation drawn beneath a node for its children,
+// omitting the vertical guide once the last sibling has been reached.
+func (g glyphs) continuation(isLast bool) string {
+	if isLast {
+		return g.blank
+	}
+	return g.vertical
 }
 
-func matchesGitignore(path string, patterns []string) bool {
-	for _, pattern := range patterns {
-		matched, _ := filepath.Match(pattern, filepath.Base(path))
-		if matched {
-			return true
+// renderOptions controls how the text tree is drawn.
+type renderOptions struct {
+	glyphs     glyphs
+	color      bool
+	colorRules []colorRule
+	showNames  bool
+	lineCounts bool
+	sizes      bool
+	ages       bool
+	// now is the time ages are measured from
+	now time.Time
+	// unit names what file totals count, "line" or "commit"
+	unit string
+	// gradient colors percentages on a truecolor gradient instead of by the
+	// color rules
+	gradient bool
+	// barWidth, if positive, draws a bar this many characters wide after
+	// each author, filled in proportion to their share
+	barWidth int
+	// stripEmail lists substrings removed from displayed emails
+	stripEmail []string
+	// stripDomain, if set, is the "@domain" removed from the end of
+	// displayed emails, matched ignoring case as domains are
+	stripDomain string
+	// compact prints each node's authors on the node's own line
+	compact bool
+	// ownerOnly prints just each file's top author, on the file's own line
+	ownerOnly bool
+	// byExtension prints each tree's per-extension ownership in place of
+	// the tree
+	byExtension bool
+	// summaryOnly prints each tree's summary in place of the tree
+	summaryOnly bool
+}
+
+// displayEmail returns email as displayed, without the configured domain and
+// substrings. An email that would be left empty is shown whole.
+func (opts renderOptions) displayEmail(email string) string {
+	stripped := email
+	if n := len(stripped) - len(opts.stripDomain); opts.stripDomain != "" && n >= 0 && strings.EqualFold(stripped[n:], opts.stripDomain) {
+		stripped = stripped[:n]
+	}
+	for _, s := range opts.stripEmail {
+		stripped = strings.ReplaceAll(stripped, s, "")
+	}
+	if stripped == "" {
+		return email
+	}
+	return stripped
+}
+
+// sharedDomain returns the "@domain" every author email in trees ends with,
+// if they all share one.
+func sharedDomain(trees []*filetree.Node) (string, bool) {
+	domain := ""
+	var visit func(n *filetree.Node) bool
+	visit = func(n *filetree.Node) bool {
+		for _, stat := range n.Authors {
+			if stat.Others || stat.Email == filetree.UncommittedAuthor {
+				continue
+			}
+			i := strings.LastIndex(stat.Email, "@")
+			if i < 0 || domain != "" && !strings.EqualFold(stat.Email[i:], domain) {
+				return false
+			}
+			domain = stat.Email[i:]
 		}
-		// Check for directory patterns like "folder/" or "folder"
-		if (strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, strings.TrimSuffix(pattern, "/"))) ||
-			(filepath.Base(path) == pattern) {
-			return true
+		for _, child := range n.Children {
+			if !visit(child) {
+				return false
+			}
 		}
+		return true
 	}
-	return false
+	for _, tree := range trees {
+		if !visit(tree) {
+			return "", false
+		}
+	}
+	return domain, domain != ""
 }
 
-type authorStat struct {
-	email      string
-	count      int
-	percentage float64
+// printTree writes the tree rooted at n to w, with the root name printed bare.
+func printTree(w io.Writer, n *filetree.Node, opts renderOptions) {
+	fmt.Fprintln(w, n.Name+inlineAuthors(n, opts))
+	printChildren(w, n, "", opts)
+	if n.Summary != nil {
+		printSummary(w, *n.Summary, opts)
+	}
 }
 
-func getFileContributions(path string) (map[string]int, int, error) {
-	cmd := fmt.Sprintf("git blame --line-porcelain %s | grep \"^author-mail\" | cut -d \"<\" -f2 | cut -d \">\" -f1", path)
-	output, err := exec.Command("bash", "-c", cmd).Output()
-	if err != nil {
-		return nil, 0, err
+// printExtensions writes the ownership of each file extension under n, one
+// section per extension.
+func printExtensions(w io.Writer, n *filetree.Node, opts renderOptions) {
+	fmt.Fprintln(w, n.Name)
+	for _, ext := range n.Extensions {
+		name := ext.Extension
+		if name == "" {
+			name = "(no extension)"
+		}
+		fmt.Fprintf(w, "\n%s: %d %s, %d %s\n", name, ext.Files, plural("file", ext.Files), ext.Total, plural(opts.unit, ext.Total))
+		for i, stat := range ext.Authors {
+			fmt.Fprintf(w, "%s%s\n", opts.glyphs.connector(i == len(ext.Authors)-1), formatAuthor(stat, formatPercentage(stat.Percentage, opts), opts))
+		}
 	}
+}
 
-	authorCounts := make(map[string]int)
-	totalLines := 0
-	for _, author := range strings.Split(strings.TrimSpace(string(output)), "\n") {
-		if author != "" {
-			authorCounts[author]++
-			totalLines++
+// printSummary writes the overall totals and top authors after the tree,
+// followed by the files tagged by --bus-factor.
+func printSummary(w io.Writer, s filetree.Summary, opts renderOptions) {
+	fmt.Fprintf(w, "\nSummary: %d %s, %d %s\n", s.Files, plural("file", s.Files), s.Total, plural(opts.unit, s.Total))
+	for i, stat := range s.Authors {
+		fmt.Fprintf(w, "%s%s\n", opts.glyphs.connector(i == len(s.Authors)-1), formatAuthor(stat, formatPercentage(stat.Percentage, opts), opts))
+	}
+	if len(s.SoleOwned) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\nSole owners: %d %s\n", len(s.SoleOwned), plural("file", len(s.SoleOwned)))
+	for i, file := range s.SoleOwned {
+		fmt.Fprintf(w, "%s%s\n", opts.glyphs.connector(i == len(s.SoleOwned)-1), file)
+	}
+}
+
+func printNode(w io.Writer, n *filetree.Node, prefix string, isLast bool, opts renderOptions) {
+	fmt.Fprintln(w, prefix+opts.glyphs.connector(isLast)+n.Name+nodeSuffix(n, opts)+inlineAuthors(n, opts))
+	printChildren(w, n, prefix+opts.glyphs.continuation(isLast), opts)
+}
+
+// printChildren prints the child nodes of n followed by its author stats.
+// The tree is fully walked and filtered before anything is printed, so the
+// last entry, and with it every guide drawn beneath it, is known up front
+// however deep the nesting.
+func printChildren(w io.Writer, n *filetree.Node, prefix string, opts renderOptions) {
+	authors := n.Authors
+	if inlined(n, opts) {
+		authors = nil
+	}
+	remaining := len(n.Children) + len(authors)
+	for _, child := range n.Children {
+		remaining--
+		printNode(w, child, prefix, remaining == 0, opts)
+	}
+	for _, stat := range authors {
+		remaining--
+		fmt.Fprintf(w, "%s%s%s\n", prefix, opts.glyphs.connector(remaining == 0), formatAuthor(stat, formatPercentage(stat.Percentage, opts), opts))
+	}
+}
+
+// inlined reports whether n's authors are printed on its own line rather
+// than beneath it.
+func inlined(n *filetree.Node, opts renderOptions) bool {
+	return opts.compact || opts.ownerOnly && n.Type == filetree.NodeFile
+}
+
+// inlineAuthors returns the author stats printed on a node's own line in
+// compact or owner-only mode, e.g. ": alice@example.com 60.0%
+// bob@example.com 40.0%".
+func inlineAuthors(n *filetree.Node, opts renderOptions) string {
+	if !inlined(n, opts) || len(n.Authors) == 0 {
+		return ""
+	}
+	stats := n.Authors
+	if opts.ownerOnly && n.Type == filetree.NodeFile {
+		top, ok := topAuthor(n)
+		if !ok {
+			return ""
 		}
+		stats = []filetree.AuthorStat{top}
 	}
-	return authorCounts, totalLines, nil
+	parts := make([]string, len(stats))
+	for i, stat := range stats {
+		author := opts.displayEmail(stat.Email)
+		switch {
+		case stat.Others:
+			author = "others"
+		case opts.showNames && stat.Name != "":
+			author = stat.Name
+		}
+		parts[i] = author + " " + formatPercentage(stat.Percentage, opts)
+	}
+	return ": " + strings.Join(parts, " ")
 }
 
-func calculateAndSortStats(authorCounts map[string]int, totalLines int) []authorStat {
-	var stats []authorStat
-	if totalLines > 0 {
-		for email, count := range authorCounts {
-			percentage := float64(count) / float64(totalLines) * 100
-			stats = append(stats, authorStat{
-				email:      email,
-				count:      count,
-				percentage: percentage,
-			})
+// nodeSuffix returns the annotation printed after a node's name, such as a
+// file's line count and size.
+func nodeSuffix(n *filetree.Node, opts renderOptions) string {
+	var notes []string
+	switch {
+	case n.Binary:
+		notes = append(notes, "binary")
+	case opts.lineCounts && n.Type == filetree.NodeFile && n.Total > 0:
+		notes = append(notes, fmt.Sprintf("%d %s", n.Total, plural(opts.unit, n.Total)))
+	case opts.lineCounts && n.Type == filetree.NodeDir && n.Files > 0:
+		notes = append(notes, fmt.Sprintf("%d %s", n.Files, plural("file", n.Files)))
+		if n.Total > 0 {
+			notes = append(notes, fmt.Sprintf("%d %s", n.Total, plural(opts.unit, n.Total)))
 		}
+	}
+	if opts.sizes && n.Type == filetree.NodeFile {
+		notes = append(notes, humanSize(n.Size))
+	}
+	if opts.ages && n.Type == filetree.NodeFile && n.Modified != nil {
+		notes = append(notes, humanAge(opts.now.Sub(*n.Modified)))
+	}
 
-		// Sort by count in descending order
-		sort.Slice(stats, func(i, j int) bool {
-			return stats[i].count > stats[j].count
-		})
+	suffix := ""
+	if len(notes) > 0 {
+		suffix = " (" + strings.Join(notes, ", ") + ")"
 	}
-	return stats
+	if n.SoleOwner {
+		suffix += " [SOLE]"
+	}
+	return suffix
 }
 
-func getPercentageColor(percentage float64) string {
+// humanAge formats how long ago something happened, e.g. "3mo ago".
+func humanAge(age time.Duration) string {
+	const day = 24 * time.Hour
 	switch {
-	case percentage > 75:
-		return colorPink
-	case percentage > 60:
-		return colorGreen
-	case percentage > 50:
-		return colorLightGreen
-	case percentage > 25:
-		return colorYellow
-	case percentage > 0:
-		return colorTeal
+	case age < time.Minute:
+		return "just now"
+	case age < time.Hour:
+		return fmt.Sprintf("%dm ago", age/time.Minute)
+	case age < day:
+		return fmt.Sprintf("%dh ago", age/time.Hour)
+	case age < 30*day:
+		return fmt.Sprintf("%dd ago", age/day)
+	case age < 365*day:
+		return fmt.Sprintf("%dmo ago", age/(30*day))
 	default:
-		return colorReset
+		return fmt.Sprintf("%dy ago", age/(365*day))
 	}
 }
 
-func printDirectories(path string, prefix string, patterns []string, showFiles bool) error {
-	fileInfo, err := os.Stat(path)
-	if err != nil {
-		return err
+// humanSize formats a size in bytes with binary units, e.g. "1.2 MB".
+func humanSize(size int64) string {
+	const unit = 1024
+	const prefixes = "KMGTPE"
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
 	}
+	value, prefix := float64(size)/unit, 0
+	for value >= unit && prefix < len(prefixes)-1 {
+		value /= unit
+		prefix++
+	}
+	return fmt.Sprintf("%.1f %cB", value, prefixes[prefix])
+}
 
-	if !fileInfo.IsDir() || matchesGitignore(path, patterns) {
-		return nil
+// plural appends an "s" to unit unless n is one.
+func plural(unit string, n int) string {
+	if n == 1 {
+		return unit
+	}
+	return unit + "s"
+}
+
+// formatAuthor renders one author stat line around an already formatted
+// percentage, e.g. "alice@example.com (60.0%)".
+func formatAuthor(stat filetree.AuthorStat, percentage string, opts renderOptions) string {
+	bar := ""
+	if opts.barWidth > 0 {
+		bar = " " + formatBar(stat.Percentage, opts)
+	}
+	switch {
+	case stat.Others:
+		return fmt.Sprintf("(others%s %s)", bar, percentage)
+	case opts.showNames && stat.Name != "":
+		return fmt.Sprintf("%s <%s>%s (%s)", stat.Name, opts.displayEmail(stat.Email), bar, percentage)
+	default:
+		return fmt.Sprintf("%s%s (%s)", opts.displayEmail(stat.Email), bar, percentage)
 	}
+}
 
-	// Print the current directory
-	fmt.Println(prefix + "├── " + fileInfo.Name())
+// formatBar draws a bar opts.barWidth characters wide, filled in proportion to
+// percentage and colored like it.
+func formatBar(percentage float64, opts renderOptions) string {
+	filled := int(math.Round(min(max(percentage, 0), 100) / 100 * float64(opts.barWidth)))
+	bar := strings.Repeat(opts.glyphs.barFull, filled) + strings.Repeat(opts.glyphs.barEmpty, opts.barWidth-filled)
+	return getPercentageColor(percentage, opts) + bar + getResetColor(opts.color)
+}
 
-	// Read directory contents
-	entries, err := os.ReadDir(path)
-	if err != nil {
-		return err
+// parseSort returns the orderings named by a --sort value. The author orders
+// keep entries in name order, and the entry orders keep authors by count.
+func parseSort(name string) (filetree.StatLess, string, error) {
+	switch name {
+	case "count":
+		return filetree.ByCount, filetree.OrderName, nil
+	case "email":
+		return filetree.ByEmail, filetree.OrderName, nil
+	case "percentage":
+		return filetree.ByPercentage, filetree.OrderName, nil
+	case "size":
+		return filetree.ByCount, filetree.OrderSize, nil
+	case "age":
+		return filetree.ByCount, filetree.OrderAge, nil
+	default:
+		return nil, "", fmt.Errorf("invalid sort order %q (want count, email, percentage, size or age)", name)
 	}
+}
 
-	// For directory-level stats when showFiles is false
-	dirAuthorCounts := make(map[string]int)
-	dirTotalLines := 0
+// stringsFlag is a flag that may be repeated, collecting every value.
+type stringsFlag []string
 
-	for i, entry := range entries {
-		newPath := filepath.Join(path, entry.Name())
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
 
-		if matchesGitignore(newPath, patterns) {
-			continue
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// setFlags returns the names of the flags given on the command line.
+func setFlags() map[string]bool {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// parseDate parses a --since value, either a local YYYY-MM-DD date or an RFC
+// 3339 timestamp. An empty value yields the zero time.
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q (want YYYY-MM-DD or RFC 3339)", value)
+	}
+	return t, nil
+}
+
+// relabel renames the nodes of the tree walked from dir for display. With a
+// base directory the root is shown as its path from base, and with fullPaths
+// every node below it shows its whole path rather than its name.
+func relabel(n *filetree.Node, dir, base string, fullPaths bool) error {
+	prefix := ""
+	if base != "" {
+		absBase, err := filepath.Abs(base)
+		if err != nil {
+			return err
 		}
+		rel, err := filepath.Rel(absBase, dir)
+		if err != nil {
+			return err
+		}
+		n.Name = filepath.ToSlash(rel)
+		prefix = n.Name
+	}
+	if !fullPaths {
+		return nil
+	}
 
-		// Adjust the prefix for the last entry
-		newPrefix := prefix + "│   "
-		if i == len(entries)-1 {
-			newPrefix = prefix + "    "
+	var visit func(n *filetree.Node, prefix string)
+	visit = func(n *filetree.Node, prefix string) {
+		for _, child := range n.Children {
+			child.Name = path.Join(prefix, child.Name)
+			visit(child, child.Name)
 		}
+	}
+	visit(n, prefix)
+	return nil
+}
 
-		if entry.IsDir() {
-			if err := printDirectories(newPath, newPrefix, patterns, showFiles); err != nil {
-				return err
-			}
-		} else {
-			authorCounts, totalLines, err := getFileContributions(newPath)
-			if err != nil {
-				return err
-			}
+// displayPath returns the path of file as listed by --list-files and ndjson
+// output: relative to root, and prefixed with root's name when several roots
+// are walked.
+func displayPath(root, file string, multipleRoots bool) string {
+	rel, err := filepath.Rel(root, file)
+	if err != nil {
+		rel = file
+	}
+	if multipleRoots {
+		rel = filepath.Join(filepath.Base(root), rel)
+	}
+	return filepath.ToSlash(rel)
+}
 
-			if showFiles {
-				stats := calculateAndSortStats(authorCounts, totalLines)
-				if len(stats) > 0 {
-					fmt.Println(newPrefix + "├── " + entry.Name())
-					for _, stat := range stats {
-						color := getPercentageColor(stat.percentage)
-						fmt.Printf("%s│   ├── %s (%s%.1f%%%s)\n", newPrefix, stat.email, color, stat.percentage, colorReset)
-					}
-				}
-			} else {
-				// Aggregate stats for directory level
-				for author, count := range authorCounts {
-					dirAuthorCounts[author] += count
-					dirTotalLines += count
-				}
-			}
+// readPaths reads newline-separated paths from r, skipping blank lines.
+func readPaths(r io.Reader) ([]string, error) {
+	var paths []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if path := strings.TrimSuffix(scanner.Text(), "\r"); path != "" {
+			paths = append(paths, path)
 		}
 	}
+	return paths, scanner.Err()
+}
 
-	// Print directory-level stats if we're not showing files
-	if !showFiles && dirTotalLines > 0 {
-		stats := calculateAndSortStats(dirAuthorCounts, dirTotalLines)
-		for _, stat := range stats {
-			color := getPercentageColor(stat.percentage)
-			fmt.Printf("%s│   ├── %s (%s%.1f%%%s)\n", prefix, stat.email, color, stat.percentage, colorReset)
-		}
+// warnBadPattern reports a malformed ignore pattern on stderr.
+func warnBadPattern(err error) {
+	fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+}
+
+// resolveRoot returns the directory to walk, falling back to the current
+// directory when arg is empty.
+func resolveRoot(arg string) (string, error) {
+	if arg == "" {
+		return os.Getwd()
 	}
 
-	return nil
+	fileInfo, err := os.Stat(arg)
+	if err != nil {
+		return "", err
+	}
+	if !fileInfo.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", arg)
+	}
+	return filepath.Abs(arg)
+}
+
+// Exit codes distinguish bad invocations from failures while running.
+const (
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+// fail prints an error message to stderr, keeping it out of the tree and
+// structured output on stdout, and exits with code.
+func fail(code int, format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format, args...)
+	os.Exit(code)
 }
 
 func main() {
@@ -226,25 +751,576 @@ func main() {
 	var showFiles bool
 	flag.BoolVar(&showFiles, "files", false, "Show files in directory tree")
 	flag.BoolVar(&showFiles, "f", false, "Show files in directory tree (shorthand)")
+	var showAll bool
+	flag.BoolVar(&showAll, "all", false, "Include dotfiles and dot-directories")
+	flag.BoolVar(&showAll, "a", false, "Include dotfiles and dot-directories (shorthand)")
+	var followSymlinks bool
+	flag.BoolVar(&followSymlinks, "follow-symlinks", false, "Descend into symlinked directories, skipping cycles")
+	var dirsFirst bool
+	flag.BoolVar(&dirsFirst, "dirs-first", true, "List directories before files (--dirs-first=false sorts purely by name)")
+	var depth int
+	flag.IntVar(&depth, "depth", 0, "Limit recursion to N levels; deeper files are counted but not blamed (0 means unlimited)")
+	flag.IntVar(&depth, "d", 0, "Limit recursion to N levels (shorthand)")
+	var gradient bool
+	flag.BoolVar(&gradient, "gradient", false, "Color percentages on a smooth red to green gradient when the terminal supports truecolor")
+	var theme string
+	flag.StringVar(&theme, "theme", "", "Color percentages with a theme from .filetree.toml, or \"default\" for the built-in colors")
+	var colorMode string
+	flag.StringVar(&colorMode, "color", "auto", "Colorize output: auto, always or never")
+	var noColor bool
+	flag.BoolVar(&noColor, "no-color", false, "Disable colored output (same as --color=never)")
+	var includeGit bool
+	flag.BoolVar(&includeGit, "include-git", false, "Include the .git directory in the tree (with --all)")
+	var jobs int
+	flag.IntVar(&jobs, "jobs", runtime.NumCPU(), "Number of git blame processes to run in parallel")
+	var retries int
+	flag.IntVar(&retries, "retries", 2, "Times to retry a file after a transient git failure, such as a locked index")
+	var breadthFirst bool
+	flag.BoolVar(&breadthFirst, "breadth-first", false, "Blame shallow files before deeper ones instead of in depth-first tree order")
+	flag.IntVar(&jobs, "j", runtime.NumCPU(), "Number of git blame processes to run in parallel (shorthand)")
+	var sortBy string
+	flag.StringVar(&sortBy, "sort", "count", "Order authors by count, email or percentage, or entries by size or age (oldest first)")
+	var reverse bool
+	flag.BoolVar(&reverse, "reverse", false, "Reverse the author order")
+	var top int
+	flag.IntVar(&top, "top", 0, "Show only the top N authors per node (0 means all)")
+	var authors stringsFlag
+	flag.Var(&authors, "author", "Only show files this author email contributed to (repeatable)")
+	var excludeAuthors stringsFlag
+	flag.Var(&excludeAuthors, "exclude-author", "Leave out authors whose email matches a pattern, e.g. '*[bot]*' (repeatable)")
+	var hideUncommitted bool
+	flag.BoolVar(&hideUncommitted, "hide-uncommitted", false, "Leave out lines changed in the working tree but not yet committed")
+	var threshold float64
+	flag.Float64Var(&threshold, "threshold", 0, "Hide authors below this percentage")
+	var showOthers bool
+	flag.BoolVar(&showOthers, "show-others", false, "Sum authors hidden by --threshold into an others line")
+	var minLines int
+	flag.IntVar(&minLines, "min-lines", 0, "Skip files with fewer than N lines")
+	var hideFiltered bool
+	flag.BoolVar(&hideFiltered, "hide-filtered", false, "Skip files whose authors all fall below --threshold")
+	var metric string
+	flag.StringVar(&metric, "metric", filetree.MetricLines, "Contribution metric: lines or commits")
+	var ignoreWhitespace bool
+	flag.BoolVar(&ignoreWhitespace, "ignore-whitespace", false, "Ignore whitespace-only changes when blaming (git blame -w)")
+	var detectMoves bool
+	flag.BoolVar(&detectMoves, "detect-moves", false, "Follow code moved or copied between files when blaming (git blame -M -C; slower)")
+	var since string
+	flag.StringVar(&since, "since", "", "Only count lines authored on or after DATE (YYYY-MM-DD or RFC 3339)")
+	var stripDomain bool
+	flag.BoolVar(&stripDomain, "strip-domain", false, "Show only the part of each email before the @ when every author shares a domain")
+	var stripPrefixes stringsFlag
+	flag.Var(&stripPrefixes, "strip-prefix", "Remove STRING from displayed emails (repeatable)")
+	var bars bool
+	flag.BoolVar(&bars, "bars", false, "Draw a bar showing each author's share")
+	var barWidth int
+	flag.IntVar(&barWidth, "bar-width", 10, "Width of the --bars bars in characters")
+	var compact bool
+	flag.BoolVar(&compact, "compact", false, "Print each entry's authors on the entry's own line")
+	var ownerOnly bool
+	flag.BoolVar(&ownerOnly, "owner-only", false, "With --files, print only each file's top author, on the file's own line")
+	var showNames bool
+	flag.BoolVar(&showNames, "show-names", false, "Show author names alongside emails")
+	var noLineCounts bool
+	flag.BoolVar(&noLineCounts, "no-line-counts", false, "Hide the line count next to each file and the file and line counts next to each directory")
+	var sizes bool
+	flag.BoolVar(&sizes, "size", false, "Show each file's size")
+	var ages bool
+	flag.BoolVar(&ages, "age", false, "Show how long ago each file last changed, according to blame")
+	var ascii bool
+	flag.BoolVar(&ascii, "ascii", false, "Draw the tree with ASCII connectors only (the default on Windows consoles)")
+	var utf8 bool
+	flag.BoolVar(&utf8, "utf8", false, "Draw the tree with Unicode box characters even where ASCII is the default")
+	var ref string
+	flag.StringVar(&ref, "ref", "", "Show ownership as of a branch, tag or commit instead of the working tree")
+	var sinceCommit string
+	flag.StringVar(&sinceCommit, "since-commit", "", "Only count lines added since REF, i.e. from commits that aren't its ancestors")
+	var mailmap string
+	flag.StringVar(&mailmap, "mailmap", "", "Extra .mailmap file used to merge author addresses")
+	var blameBackend string
+	flag.StringVar(&blameBackend, "blame-backend", "", "Blame with the git binary (git) or in-process (go-git, committed lines only, no mailmap); defaults to git, or go-git when git isn't installed")
+	var excludes stringsFlag
+	flag.Var(&excludes, "exclude", "Exclude paths matching a gitignore-style pattern (repeatable; patterns accumulate)")
+	var ignoreCase bool
+	flag.BoolVar(&ignoreCase, "ignore-case", false, "Match ignore patterns regardless of case (default from git's core.ignorecase)")
+	var ignoreGenerated bool
+	flag.BoolVar(&ignoreGenerated, "ignore-generated", false, "Exclude generated files such as *.pb.go, minified assets and lock files")
+	var includeOnly stringsFlag
+	flag.Var(&includeOnly, "include-only", "Only show files matching a pattern (repeatable; ignores take precedence)")
+	var maxFiles int
+	flag.IntVar(&maxFiles, "max-files", 10000, "Abort if more than N files would be blamed (0 means unlimited)")
+	var noBlame bool
+	flag.BoolVar(&noBlame, "no-blame", false, "Print the tree only, without running git blame")
+	var watch bool
+	flag.BoolVar(&watch, "watch", false, "Keep running and redraw the tree whenever files under the roots change")
+	var fromStdin bool
+	flag.BoolVar(&fromStdin, "from-stdin", false, "Blame the newline-separated file paths read from stdin instead of walking a directory")
+	var listFiles bool
+	flag.BoolVar(&listFiles, "list-files", false, "Print the paths of the files that would be blamed, one per line, without blaming them")
+	var noCache bool
+	flag.BoolVar(&noCache, "no-cache", false, "Blame every file again instead of reusing cached results")
+	var busFactor bool
+	flag.BoolVar(&busFactor, "bus-factor", false, "Tag files mostly written by one author with [SOLE]")
+	var busFactorThreshold float64
+	flag.Float64Var(&busFactorThreshold, "bus-factor-threshold", 90, "Share of a file one author must exceed for --bus-factor")
+	var busFactorOnly bool
+	flag.BoolVar(&busFactorOnly, "bus-factor-only", false, "Only show files tagged by --bus-factor (implies --bus-factor and --files)")
+	var groupBy string
+	flag.StringVar(&groupBy, "group-by", filetree.GroupAuthor, "Report ownership per author or per email domain")
+	var prune bool
+	flag.BoolVar(&prune, "prune", false, "Leave out directories with no files to show")
+	var collapse bool
+	flag.BoolVar(&collapse, "collapse", false, "Merge directories that only hold one subdirectory into one line")
+	var summary bool
+	flag.BoolVar(&summary, "summary", false, "Print overall totals and top authors after the tree, or add them to JSON output")
+	var summaryOnly bool
+	flag.BoolVar(&summaryOnly, "summary-only", false, "Print only the overall totals, top authors and --bus-factor files, without the tree")
+	var byExtension bool
+	flag.BoolVar(&byExtension, "by-extension", false, "Print ownership per file extension instead of the tree")
+	var quiet bool
+	flag.BoolVar(&quiet, "quiet", false, "Don't show blame progress on stderr")
+	var relativeTo string
+	flag.StringVar(&relativeTo, "relative-to", "", "Show each root as its path from DIR")
+	var fullPaths bool
+	flag.BoolVar(&fullPaths, "full-paths", false, "Show each node's full path instead of its name")
+	var verbose bool
+	flag.BoolVar(&verbose, "verbose", false, "Report files git blame fails on to stderr")
+	var format string
+	flag.StringVar(&format, "format", formatText, "Output format: text, json, markdown, csv, tsv, dot, html or ndjson")
+	var configPath string
+	flag.StringVar(&configPath, "config", "", "Read settings and ignore patterns from FILE instead of each root's "+filetree.ConfigFile)
+	var output string
+	flag.StringVar(&output, "output", "", "Write the tree to FILE instead of stdout; the format follows its extension unless --format is given")
+	flag.StringVar(&output, "o", "", "Write the tree to FILE instead of stdout (shorthand)")
+	var jsonOutput bool
+	flag.BoolVar(&jsonOutput, "json", false, "Print the tree as JSON (same as --format=json)")
+	var showVersion bool
+	flag.BoolVar(&showVersion, "version", false, "Print version information and exit")
 	flag.Parse()
 
-	// Get current directory
-	dir, err := os.Getwd()
-	if err != nil {
-		fmt.Printf("Error getting current directory: %v\n", err)
+	if showVersion {
+		fmt.Printf("filetree %s (commit %s, built %s)\n", version, commit, date)
 		return
 	}
 
-	// Load ignore patterns from both .gitignore and .filetree.toml
-	patterns, err := loadIgnorePatterns(dir)
-	if err != nil {
-		fmt.Printf("Error loading ignore patterns: %v\n", err)
+	// "filetree completion SHELL" prints a completion script instead of a tree
+	if flag.Arg(0) == "completion" {
+		if flag.NArg() != 2 {
+			fail(exitUsage, "Usage: filetree completion %s\n", strings.Join(shells, "|"))
+		}
+		if err := writeCompletion(os.Stdout, flag.Arg(1)); err != nil {
+			fail(exitUsage, "Error: %v\n", err)
+		}
 		return
 	}
 
-	// Print the directory tree
-	if err := printDirectories(dir, "", patterns, showFiles); err != nil {
-		fmt.Printf("Error printing directory tree: %v\n", err)
+	var stdinPaths []string
+	if fromStdin {
+		if flag.NArg() > 0 {
+			fail(exitUsage, "Error: --from-stdin reads paths from stdin and takes no directories\n")
+		}
+		var err error
+		if stdinPaths, err = readPaths(os.Stdin); err != nil {
+			fail(exitFailure, "Error reading paths from stdin: %v\n", err)
+		}
+	}
+
+	// Walk each directory given as an argument, or the current directory.
+	// Roots that can't be walked are skipped with a warning.
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	var dirs []string
+	for _, arg := range args {
+		dir, err := resolveRoot(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", arg, err)
+			continue
+		}
+		dirs = append(dirs, dir)
+	}
+	if len(dirs) == 0 {
+		fail(exitFailure, "Error: no directory to walk\n")
+	}
+
+	// Without git installed, blame in-process unless the git binary was
+	// asked for, in which case fail now rather than on every file
+	_, lookErr := exec.LookPath("git")
+	withoutGit := false
+	if !noBlame && lookErr != nil {
+		switch {
+		case blameBackend == filetree.BackendGit:
+			fail(exitFailure, "Error: git is required for blame but was not found on PATH; use --no-blame to print the tree only\n")
+		case ref != "":
+			fail(exitFailure, "Error: git is required for --ref but was not found on PATH\n")
+		case blameBackend == "":
+			blameBackend, withoutGit = filetree.BackendGoGit, true
+		}
+	}
+	for _, dir := range dirs {
+		if !noBlame && !filetree.InsideWorkTree(dir) {
+			fail(exitFailure, "Error: %s is not inside a git work tree, so there is nothing to blame; use --no-blame to print the tree only\n", dir)
+		}
+		if ref != "" {
+			if err := filetree.VerifyRef(dir, ref); err != nil {
+				fail(exitUsage, "Error: %v\n", err)
+			}
+		}
+	}
+	// The commit is resolved so cached blame results are keyed to it rather
+	// than to a branch name that may move
+	if sinceCommit != "" {
+		var err error
+		if sinceCommit, err = filetree.ResolveCommit(dirs[0], sinceCommit); err != nil {
+			fail(exitUsage, "Error: %v\n", err)
+		}
+	}
+
+	// Settings from --config, or else the first root's .filetree.toml,
+	// replace the built-in defaults, and flags given on the command line
+	// replace both
+	cfgPath := configPath
+	if cfgPath == "" {
+		cfgPath = filepath.Join(dirs[0], filetree.ConfigFile)
+	} else if _, err := os.Stat(cfgPath); err != nil {
+		fail(exitUsage, "Error: %v\n", err)
+	}
+	cfg, err := filetree.LoadConfig(cfgPath)
+	if err != nil {
+		fail(exitFailure, "Error loading %s: %v\n", cfgPath, err)
+	}
+	set := setFlags()
+	if cfg.ShowFiles != nil && !set["files"] && !set["f"] {
+		showFiles = *cfg.ShowFiles
+	}
+	if cfg.MaxDepth != 0 && !set["depth"] && !set["d"] {
+		depth = cfg.MaxDepth
+	}
+	if cfg.Color != "" && !set["color"] {
+		colorMode = cfg.Color
+	}
+	if cfg.Sort != "" && !set["sort"] {
+		sortBy = cfg.Sort
+	}
+	if cfg.Top != 0 && !set["top"] {
+		top = cfg.Top
+	}
+	if cfg.Threshold != 0 && !set["threshold"] {
+		threshold = cfg.Threshold
+	}
+	if cfg.BusFactorThreshold != 0 && !set["bus-factor-threshold"] {
+		busFactorThreshold = cfg.BusFactorThreshold
+	}
+	excludeSource := "--exclude"
+	if len(cfg.Exclude) > 0 && !set["exclude"] {
+		excludes, excludeSource = cfg.Exclude, cfgPath
+	}
+	excludes = filetree.ValidPatterns(excludeSource, excludes, warnBadPattern)
+	includeOnly = filetree.ValidPatterns("--include-only", includeOnly, warnBadPattern)
+	if ignoreGenerated {
+		generated := filetree.GeneratedPatterns
+		if len(cfg.Generated) > 0 {
+			generated = filetree.ValidPatterns(cfgPath, cfg.Generated, warnBadPattern)
+		}
+		excludes = append(excludes, generated...)
+	}
+
+	// Files are never colored unless asked for
+	if noColor || output != "" && colorMode == "auto" {
+		colorMode = "never"
+	}
+	useColor, err := colorEnabled(colorMode)
+	if err != nil {
+		fail(exitUsage, "Error: %v\n", err)
+	}
+	if cfg.Theme != "" && !set["theme"] {
+		theme = cfg.Theme
+	}
+	colorRules := defaultColorRules
+	switch rules, ok := cfg.Themes[theme]; {
+	case ok:
+		if colorRules, err = parseColorRules(rules); err != nil {
+			fail(exitFailure, "Error loading %s: %v\n", cfgPath, err)
+		}
+	case theme != "" && theme != defaultTheme:
+		fail(exitUsage, "Error: unknown theme %q (want %s)\n", theme, strings.Join(themeNames(cfg), ", "))
+	case theme == "" && len(cfg.ColorRules) > 0:
+		if colorRules, err = parseColorRules(cfg.ColorRules); err != nil {
+			fail(exitFailure, "Error loading %s: %v\n", cfgPath, err)
+		}
+	}
+
+	less, entryOrder, err := parseSort(sortBy)
+	if err != nil {
+		fail(exitUsage, "Error: %v\n", err)
+	}
+	if reverse {
+		less = filetree.Reverse(less)
+	}
+	if fileFormat, ok := formatForFile(output); ok && !set["format"] {
+		format = fileFormat
+	}
+	if jsonOutput {
+		format = formatJSON
+	}
+	if !validFormat(format) {
+		fail(exitUsage, "Error: invalid format %q (want %s)\n", format, strings.Join(formats, ", "))
+	}
+	if bars && barWidth <= 0 {
+		fail(exitUsage, "Error: --bar-width must be positive\n")
+	}
+	if byExtension && (noBlame || format != formatText && format != formatJSON) {
+		fail(exitUsage, "Error: --by-extension needs blame and text or json output\n")
+	}
+	if summaryOnly && format != formatText && format != formatJSON {
+		fail(exitUsage, "Error: --summary-only needs text or json output\n")
+	}
+	if metric != filetree.MetricLines && metric != filetree.MetricCommits {
+		fail(exitUsage, "Error: invalid metric %q (want lines or commits)\n", metric)
+	}
+	if groupBy != filetree.GroupAuthor && groupBy != filetree.GroupDomain {
+		fail(exitUsage, "Error: invalid grouping %q (want author or domain)\n", groupBy)
+	}
+	sinceTime, err := parseDate(since)
+	if err != nil {
+		fail(exitUsage, "Error: %v\n", err)
+	}
+
+	if busFactorOnly {
+		busFactor = true
+		showFiles = true
+	}
+	if summaryOnly {
+		summary = true
+	}
+	if !busFactor {
+		busFactorThreshold = 0
+	}
+
+	walkOpts := filetree.Options{
+		IncludeOnly:        includeOnly,
+		ShowHidden:         showAll,
+		ShowFiles:          showFiles,
+		DirsFirst:          dirsFirst,
+		EntryOrder:         entryOrder,
+		FollowSymlinks:     followSymlinks,
+		Depth:              depth,
+		Jobs:               jobs,
+		Retries:            retries,
+		BreadthFirst:       breadthFirst,
+		SortBy:             less,
+		Top:                top,
+		Authors:            authors,
+		ExcludeAuthors:     excludeAuthors,
+		HideUncommitted:    hideUncommitted,
+		Threshold:          threshold,
+		ShowOthers:         showOthers,
+		MinLines:           minLines,
+		HideFiltered:       hideFiltered,
+		BusFactorThreshold: busFactorThreshold,
+		BusFactorOnly:      busFactorOnly,
+		StreamFiles:        format == formatNDJSON,
+		GroupBy:            groupBy,
+		Prune:              prune,
+		Collapse:           collapse,
+		Summary:            summary,
+		ByExtension:        byExtension,
+		NoBlame:            noBlame,
+		MaxFiles:           maxFiles,
+		Blame: filetree.BlameOptions{
+			Backend:          blameBackend,
+			MailmapFile:      mailmap,
+			Metric:           metric,
+			IgnoreWhitespace: ignoreWhitespace,
+			DetectMoves:      detectMoves,
+			Since:            sinceTime,
+			Ref:              ref,
+			SinceCommit:      sinceCommit,
+		},
+	}
+	if !noBlame {
+		if err := filetree.CheckBackend(walkOpts.Blame); err != nil && withoutGit {
+			fail(exitFailure, "Error: git was not found on PATH, and %v; install git or use --no-blame\n", err)
+		} else if err != nil {
+			fail(exitUsage, "Error: %v\n", err)
+		}
+	}
+	// Without a usable cache directory every file is simply blamed again
+	if !noCache {
+		if cacheDir, err := filetree.DefaultCacheDir(); err == nil {
+			walkOpts.CacheDir = cacheDir
+		}
+	}
+	if !quiet && isTerminal(os.Stderr) {
+		walkOpts.OnProgress = printProgress
+	}
+	if verbose {
+		walkOpts.OnBlameError = func(path string, err error) {
+			fmt.Fprintf(os.Stderr, "Skipping %s: git blame failed: %v\n", path, err)
+		}
+	}
+	if watch && output != "" {
+		fail(exitUsage, "Error: --watch redraws the terminal and can't be used with --output\n")
+	}
+	// Output is written as UTF-8 as is. On a Windows console, os.Stdout
+	// already converts it to UTF-16 for the console, runes split across
+	// writes included, so only the connector choice depends on the console.
+	var out io.Writer = os.Stdout
+	var outFile *os.File
+	if output != "" {
+		var err error
+		if outFile, err = os.Create(output); err != nil {
+			fail(exitFailure, "Error creating output file: %v\n", err)
+		}
+		out = outFile
+	}
+
+	walkOpts.OnBadPattern = warnBadPattern
+
+	// Cancel in-flight git blame processes on Ctrl-C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	renderOpts := renderOptions{
+		glyphs:     unicodeGlyphs,
+		color:      useColor,
+		colorRules: colorRules,
+		showNames:  showNames,
+		stripEmail: stripPrefixes,
+		gradient:   gradient && trueColorSupported(),
+		compact:    compact,
+		ownerOnly:  ownerOnly,
+		lineCounts: !noLineCounts,
+		sizes:      sizes,
+		ages:       ages,
+		unit:       strings.TrimSuffix(metric, "s"),
+
+		byExtension: byExtension,
+		summaryOnly: summaryOnly,
+	}
+	switch {
+	case ascii:
+		renderOpts.glyphs = asciiGlyphs
+	case !utf8:
+		renderOpts.glyphs = defaultGlyphs(runtime.GOOS, os.Getenv)
+	}
+	if bars {
+		renderOpts.barWidth = barWidth
+	}
+	walkDirs := dirs
+	if fromStdin {
+		walkDirs = nil
+	}
+	// render walks every root, or blames the paths read from stdin, and
+	// writes the trees
+	render := func() {
+		// Each root is walked with its own ignore patterns and keeps its own
+		// stats
+		var trees []*filetree.Node
+		if fromStdin {
+			if format == formatNDJSON {
+				walkOpts.OnFile = func(path string, authors []filetree.AuthorStat) {
+					if err := writeNDJSONFile(out, displayPath(dirs[0], path, false), authors); err != nil {
+						fail(exitFailure, "Error writing output: %v\n", err)
+					}
+				}
+			}
+			tree, err := filetree.BlamePaths(ctx, stdinPaths, walkOpts)
+			if watch && ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				fail(exitFailure, "Error: %v\n", err)
+			}
+			tree.Name = "(stdin)"
+			trees = append(trees, tree)
+		}
+		for _, dir := range walkDirs {
+			// Load ignore patterns from .gitignore, .filetreeignore and
+			// the config file
+			patterns, err := filetree.LoadIgnorePatterns(dir, configPath, warnBadPattern)
+			if err != nil {
+				fail(exitFailure, "Error loading ignore patterns: %v\n", err)
+			}
+			if !includeGit {
+				patterns = append(patterns, filetree.GitDirPattern)
+			}
+			walkOpts.Patterns = append(patterns, excludes...)
+			walkOpts.IgnoreCase = ignoreCase
+			if !set["ignore-case"] {
+				walkOpts.IgnoreCase = filetree.IgnoreCaseConfigured(dir)
+			}
+			if format == formatNDJSON {
+				walkOpts.OnFile = func(path string, authors []filetree.AuthorStat) {
+					if err := writeNDJSONFile(out, displayPath(dir, path, len(dirs) > 1), authors); err != nil {
+						fail(exitFailure, "Error writing output: %v\n", err)
+					}
+				}
+			}
+
+			if listFiles {
+				paths, err := filetree.Files(ctx, dir, walkOpts)
+				if err != nil {
+					fail(exitFailure, "Error walking directory tree: %v\n", err)
+				}
+				for _, path := range paths {
+					fmt.Fprintln(out, displayPath(dir, path, len(dirs) > 1))
+				}
+				continue
+			}
+
+			tree, err := filetree.Walk(ctx, dir, walkOpts)
+			// Ctrl-C while watching interrupts a render, which is how
+			// watching stops
+			if watch && ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, filetree.ErrTooManyFiles) {
+				fail(exitFailure, "Error: %v files; narrow the scope with a subdirectory, --exclude or --depth, or raise --max-files\n", err)
+			}
+			if err != nil {
+				fail(exitFailure, "Error walking directory tree: %v\n", err)
+			}
+			// Only the tree views are relabelled; structured formats keep names
+			if format == formatText || format == formatMarkdown {
+				if err := relabel(tree, dir, relativeTo, fullPaths); err != nil {
+					fail(exitFailure, "Error: %v\n", err)
+				}
+			}
+			trees = append(trees, tree)
+		}
+		// Listed files were already written as each root was walked
+		if listFiles {
+			return
+		}
+		opts := renderOpts
+		opts.now = time.Now()
+		if stripDomain {
+			if domain, ok := sharedDomain(trees); ok {
+				opts.stripDomain = domain
+			}
+		}
+		if err := writeOutput(out, format, trees, opts); err != nil {
+			fail(exitFailure, "Error writing output: %v\n", err)
+		}
+	}
+
+	if watch {
+		// Warnings about bad patterns are left to the render
+		watchPatterns := func(root string) []string {
+			patterns, _ := filetree.LoadIgnorePatterns(root, configPath, nil)
+			return append(patterns, excludes...)
+		}
+		watchRoots(ctx, dirs, watchPatterns, func() {
+			fmt.Fprint(out, clearScreen)
+			render()
+		})
 		return
 	}
+	render()
+	if outFile != nil {
+		if err := outFile.Close(); err != nil {
+			fail(exitFailure, "Error writing output: %v\n", err)
+		}
+	}
 }
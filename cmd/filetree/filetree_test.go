@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"filetree"
+)
+
+func TestParseColor(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    termColor
+		wantErr bool
+	}{
+		{"pink", termColor{palette: colorPink}, false},
+		{"red", termColor{palette: 1}, false},
+		{"244", termColor{palette: 244}, false},
+		{"#ff8000", termColor{trueColor: true, r: 0xff, g: 0x80}, false},
+		{"256", termColor{}, true},
+		{"-1", termColor{}, true},
+		{"#12345", termColor{}, true},
+		{"#gggggg", termColor{}, true},
+		{"mauve", termColor{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseColor(tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseColor(%q) = %+v, %v; want %+v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestColorCodes(t *testing.T) {
+	tests := []struct {
+		color termColor
+		ansi  string
+		hex   string
+	}{
+		{termColor{palette: 2}, "\033[32m", "#008000"},
+		{termColor{palette: 9}, "\033[38;5;9m", "#ff0000"},
+		{termColor{palette: colorPink}, "\033[38;5;205m", "#ff5faf"},
+		{termColor{palette: 16}, "\033[38;5;16m", "#000000"},
+		{termColor{palette: 244}, "\033[38;5;244m", "#808080"},
+		{termColor{trueColor: true, r: 1, g: 2, b: 255}, "\033[38;2;1;2;255m", "#0102ff"},
+	}
+	for _, tt := range tests {
+		if got := tt.color.ansi(); got != tt.ansi {
+			t.Errorf("%+v.ansi() = %q, want %q", tt.color, got, tt.ansi)
+		}
+		if got := tt.color.hex(); got != tt.hex {
+			t.Errorf("%+v.hex() = %q, want %q", tt.color, got, tt.hex)
+		}
+	}
+}
+
+func TestRuleColor(t *testing.T) {
+	tests := []struct {
+		percentage float64
+		want       int
+	}{
+		{100, colorPink},
+		{75.1, colorPink},
+		{75, colorGreen},
+		{55, colorLightGreen},
+		{50, colorYellow},
+		{25.5, colorYellow},
+		{10, colorTeal},
+		{0, -1},
+	}
+	for _, tt := range tests {
+		color, ok := ruleColor(tt.percentage, defaultColorRules)
+		got := color.palette
+		if !ok {
+			got = -1
+		}
+		if got != tt.want {
+			t.Errorf("ruleColor(%v) = %d, want %d", tt.percentage, got, tt.want)
+		}
+	}
+}
+
+func TestGradientColor(t *testing.T) {
+	tests := []struct {
+		percentage float64
+		r, g       uint8
+	}{
+		{-10, 255, 0},
+		{0, 255, 0},
+		{25, 255, 128},
+		{50, 255, 255},
+		{75, 128, 255},
+		{100, 0, 255},
+		{150, 0, 255},
+	}
+	for _, tt := range tests {
+		got := gradientColor(tt.percentage)
+		if want := (termColor{trueColor: true, r: tt.r, g: tt.g}); got != want {
+			t.Errorf("gradientColor(%v) = %+v, want %+v", tt.percentage, got, want)
+		}
+	}
+}
+
+func TestColorEnabled(t *testing.T) {
+	tests := []struct {
+		mode    string
+		noColor string
+		want    bool
+		wantErr bool
+	}{
+		{"always", "1", true, false},
+		{"never", "", false, false},
+		// Test output isn't a terminal, so auto never colors here
+		{"auto", "", false, false},
+		{"auto", "1", false, false},
+		{"sometimes", "", false, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("NO_COLOR", tt.noColor)
+		got, err := colorEnabled(tt.mode)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("colorEnabled(%q) with NO_COLOR=%q = %v, %v; want %v, error %v", tt.mode, tt.noColor, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestDefaultGlyphs(t *testing.T) {
+	tests := []struct {
+		goos      string
+		wtSession string
+		want      glyphs
+	}{
+		{"linux", "", unicodeGlyphs},
+		{"darwin", "", unicodeGlyphs},
+		{"windows", "", asciiGlyphs},
+		{"windows", "{1234}", unicodeGlyphs},
+	}
+	for _, tt := range tests {
+		getenv := func(key string) string {
+			if key == "WT_SESSION" {
+				return tt.wtSession
+			}
+			return ""
+		}
+		if got := defaultGlyphs(tt.goos, getenv); got != tt.want {
+			t.Errorf("defaultGlyphs(%q) with WT_SESSION=%q = %+v, want %+v", tt.goos, tt.wtSession, got, tt.want)
+		}
+	}
+}
+
+func TestFormatBar(t *testing.T) {
+	tests := []struct {
+		percentage float64
+		want       string
+	}{
+		{0, "░░░░░░░░░░"},
+		{24, "██░░░░░░░░"},
+		{25, "███░░░░░░░"},
+		{100, "██████████"},
+		{120, "██████████"},
+	}
+	opts := renderOptions{glyphs: unicodeGlyphs, barWidth: 10}
+	for _, tt := range tests {
+		if got := formatBar(tt.percentage, opts); got != tt.want {
+			t.Errorf("formatBar(%v) = %q, want %q", tt.percentage, got, tt.want)
+		}
+	}
+}
+
+func TestHumanUnits(t *testing.T) {
+	sizes := []struct {
+		size int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KB"},
+		{1536, "1.5 KB"},
+		{5 << 20, "5.0 MB"},
+		{3 << 40, "3.0 TB"},
+	}
+	for _, tt := range sizes {
+		if got := humanSize(tt.size); got != tt.want {
+			t.Errorf("humanSize(%d) = %q, want %q", tt.size, got, tt.want)
+		}
+	}
+
+	const day = 24 * time.Hour
+	ages := []struct {
+		age  time.Duration
+		want string
+	}{
+		{30 * time.Second, "just now"},
+		{5 * time.Minute, "5m ago"},
+		{3 * time.Hour, "3h ago"},
+		{2 * day, "2d ago"},
+		{95 * day, "3mo ago"},
+		{800 * day, "2y ago"},
+	}
+	for _, tt := range ages {
+		if got := humanAge(tt.age); got != tt.want {
+			t.Errorf("humanAge(%v) = %q, want %q", tt.age, got, tt.want)
+		}
+	}
+}
+
+func TestFormatAuthor(t *testing.T) {
+	stat := filetree.AuthorStat{Name: "Alice", Email: "alice@corp.example.com", Count: 3, Percentage: 60}
+	tests := []struct {
+		name string
+		stat filetree.AuthorStat
+		opts renderOptions
+		want string
+	}{
+		{"email", stat, renderOptions{}, "alice@corp.example.com (60.0%)"},
+		{"name", stat, renderOptions{showNames: true}, "Alice <alice@corp.example.com> (60.0%)"},
+		{"nameless", filetree.AuthorStat{Email: "x@y", Percentage: 60}, renderOptions{showNames: true}, "x@y (60.0%)"},
+		{"strip", stat, renderOptions{stripEmail: []string{"@corp.example.com"}}, "alice (60.0%)"},
+		{"strip several", stat, renderOptions{stripEmail: []string{"corp.", "example.com"}}, "alice@ (60.0%)"},
+		{"strip everything", stat, renderOptions{stripEmail: []string{"alice@corp.example.com"}}, "alice@corp.example.com (60.0%)"},
+		{"strip domain", stat, renderOptions{stripDomain: "@Corp.Example.COM"}, "alice (60.0%)"},
+		{"strip domain only at the end", filetree.AuthorStat{Email: "corp.example.com@corp.example.com", Percentage: 60}, renderOptions{stripDomain: "@corp.example.com"}, "corp.example.com (60.0%)"},
+		{"bar", stat, renderOptions{glyphs: asciiGlyphs, barWidth: 5}, "alice@corp.example.com ###-- (60.0%)"},
+		{"others", filetree.AuthorStat{Others: true, Percentage: 60}, renderOptions{}, "(others 60.0%)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatAuthor(tt.stat, "60.0%", tt.opts); got != tt.want {
+				t.Errorf("formatAuthor() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSharedDomain(t *testing.T) {
+	tree := func(emails ...string) *filetree.Node {
+		n := &filetree.Node{Type: filetree.NodeDir, Children: []*filetree.Node{{Type: filetree.NodeFile}}}
+		for _, email := range emails {
+			n.Children[0].Authors = append(n.Children[0].Authors, filetree.AuthorStat{Email: email})
+		}
+		return n
+	}
+	tests := []struct {
+		name   string
+		trees  []*filetree.Node
+		domain string
+		ok     bool
+	}{
+		{"shared", []*filetree.Node{tree("a@x.org", "b@x.org")}, "@x.org", true},
+		{"across roots", []*filetree.Node{tree("a@x.org"), tree("b@x.org")}, "@x.org", true},
+		{"uncommitted ignored", []*filetree.Node{tree("a@x.org", filetree.UncommittedAuthor)}, "@x.org", true},
+		{"case differs", []*filetree.Node{tree("a@X.org", "b@x.org")}, "@x.org", true},
+		{"mixed", []*filetree.Node{tree("a@x.org", "b@y.org")}, "", false},
+		{"mixed across roots", []*filetree.Node{tree("a@x.org"), tree("b@y.org")}, "", false},
+		{"no at sign", []*filetree.Node{tree("a@x.org", "root")}, "", false},
+		{"no authors", []*filetree.Node{tree()}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domain, ok := sharedDomain(tt.trees)
+			if domain != tt.domain || ok != tt.ok {
+				t.Errorf("sharedDomain() = %q, %v; want %q, %v", domain, ok, tt.domain, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseSort(t *testing.T) {
+	tests := []struct {
+		name    string
+		order   string
+		wantErr bool
+	}{
+		{"count", filetree.OrderName, false},
+		{"email", filetree.OrderName, false},
+		{"percentage", filetree.OrderName, false},
+		{"size", filetree.OrderSize, false},
+		{"age", filetree.OrderAge, false},
+		{"lines", "", true},
+	}
+	for _, tt := range tests {
+		less, order, err := parseSort(tt.name)
+		if order != tt.order || (err != nil) != tt.wantErr || (err == nil) != (less != nil) {
+			t.Errorf("parseSort(%q) = %v, %q, %v", tt.name, less != nil, order, err)
+		}
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{"", time.Time{}, false},
+		{"2024-03-01", time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local), false},
+		{"2024-03-01T12:00:00Z", time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), false},
+		{"01/03/2024", time.Time{}, true},
+		{"yesterday", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseDate(tt.in)
+		if !got.Equal(tt.want) || (err != nil) != tt.wantErr {
+			t.Errorf("parseDate(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestFormatForFile(t *testing.T) {
+	tests := []struct {
+		path   string
+		format string
+		ok     bool
+	}{
+		{"out.json", formatJSON, true},
+		{"OUT.HTML", formatHTML, true},
+		{"graph.gv", formatDOT, true},
+		{"files.jsonl", formatNDJSON, true},
+		{"dir/report.md", formatMarkdown, true},
+		{"report", "", false},
+		{"report.pdf", "", false},
+	}
+	for _, tt := range tests {
+		format, ok := formatForFile(tt.path)
+		if format != tt.format || ok != tt.ok {
+			t.Errorf("formatForFile(%q) = %q, %v; want %q, %v", tt.path, format, ok, tt.format, tt.ok)
+		}
+	}
+}
+
+func TestReadPaths(t *testing.T) {
+	paths, err := readPaths(strings.NewReader("a.go\r\n\nsrc/b c.go\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.go", "src/b c.go"}; !slices.Equal(paths, want) {
+		t.Errorf("readPaths() = %q, want %q", paths, want)
+	}
+}
+
+func TestDisplayPath(t *testing.T) {
+	root := filepath.Join(string(filepath.Separator), "repo", "proj")
+	tests := []struct {
+		file     string
+		multiple bool
+		want     string
+	}{
+		{filepath.Join(root, "src", "a.go"), false, "src/a.go"},
+		{filepath.Join(root, "src", "a.go"), true, "proj/src/a.go"},
+		{filepath.Join(root, "a.go"), false, "a.go"},
+	}
+	for _, tt := range tests {
+		if got := displayPath(root, tt.file, tt.multiple); got != tt.want {
+			t.Errorf("displayPath(%q, %v) = %q, want %q", tt.file, tt.multiple, got, tt.want)
+		}
+	}
+}
+
+func TestRelabel(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "a", "proj")
+	tests := []struct {
+		name      string
+		base      string
+		fullPaths bool
+		want      []string
+	}{
+		{"names", "", false, []string{"proj", "src", "main.go", "a,b.go", "README.md"}},
+		{"relative to", base, false, []string{"a/proj", "src", "main.go", "a,b.go", "README.md"}},
+		{"full paths", "", true, []string{"proj", "src", "src/main.go", "src/a,b.go", "README.md"}},
+		{"relative full paths", base, true, []string{"a/proj", "a/proj/src", "a/proj/src/main.go", "a/proj/src/a,b.go", "a/proj/README.md"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree := sampleTree()
+			if err := relabel(tree, dir, tt.base, tt.fullPaths); err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			var visit func(n *filetree.Node)
+			visit = func(n *filetree.Node) {
+				names = append(names, n.Name)
+				for _, child := range n.Children {
+					visit(child)
+				}
+			}
+			visit(tree)
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("names %q, want %q", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveRoot(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "f")
+	os.WriteFile(file, nil, 0o644)
+	if got, err := resolveRoot(dir); err != nil || got != dir {
+		t.Errorf("resolveRoot(dir) = %q, %v", got, err)
+	}
+	if wd, _ := os.Getwd(); wd != "" {
+		if got, err := resolveRoot(""); err != nil || got != wd {
+			t.Errorf("resolveRoot(\"\") = %q, %v; want %q", got, err, wd)
+		}
+	}
+	for _, arg := range []string{file, filepath.Join(dir, "missing")} {
+		if _, err := resolveRoot(arg); err == nil {
+			t.Errorf("resolveRoot(%q) succeeded", arg)
+		}
+	}
+}
+
+func TestPrintExtensions(t *testing.T) {
+	tree := &filetree.Node{Name: "proj", Type: filetree.NodeDir, Extensions: []filetree.ExtensionSummary{
+		{Extension: ".go", Files: 2, Total: 11, Authors: []filetree.AuthorStat{{Email: "a@x.org", Count: 11, Percentage: 100}}},
+		{Extension: "", Files: 1, Total: 1, Authors: []filetree.AuthorStat{{Email: "b@x.org", Count: 1, Percentage: 100}}},
+	}}
+	var b bytes.Buffer
+	opts := testRenderOptions()
+	opts.byExtension = true
+	if err := writeOutput(&b, formatText, []*filetree.Node{tree, tree}, opts); err != nil {
+		t.Fatal(err)
+	}
+	section := `proj
+
+.go: 2 files, 11 lines
+└── a@x.org (100.0%)
+
+(no extension): 1 file, 1 line
+└── b@x.org (100.0%)
+`
+	if got, want := b.String(), section+"\n"+section; got != want {
+		t.Errorf("output:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+
+	"filetree"
+)
+
+// htmlTemplate renders trees as a page of collapsible nested lists.
+// Directories are <details> elements, and each author gets a bar as wide as
+// their share, colored like the terminal output.
+const htmlTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{range $i, $tree := .Trees}}{{if $i}}, {{end}}{{$tree.Name}}{{end}} ownership</title>
+<style>
+body { font-family: sans-serif; }
+ul { list-style: none; padding-left: 1.5em; }
+summary { cursor: pointer; font-weight: bold; }
+.authors { margin: 0.2em 0 0.5em; padding-left: 1.5em; }
+.author { display: flex; align-items: center; gap: 0.5em; font-size: 0.9em; }
+.bar { height: 0.8em; min-width: 1px; }
+.note { color: #888; }
+</style>
+</head>
+<body>
+{{range .Trees}}<ul>{{template "node" .}}</ul>
+{{end}}</body>
+</html>
+{{define "node"}}<li>
+{{- if eq .Type "dir"}}<details open><summary>{{.Name}}/</summary>{{template "authors" .}}
+{{- if .Children}}<ul>{{range .Children}}{{template "node" .}}{{end}}</ul>{{end}}</details>
+{{- else}}{{.Name}}{{with suffix .}} <span class="note">{{.}}</span>{{end}}{{template "authors" .}}{{end -}}
+</li>
+{{end}}
+{{define "authors"}}{{if .Authors}}<div class="authors">
+{{- range .Authors}}<div class="author"><span class="bar" style="width: {{printf "%.1f" .Percentage}}%; background: {{color .Percentage}}"></span>{{author .}}</div>{{end -}}
+</div>{{end}}{{end}}`
+
+// printHTML writes trees to w as a standalone HTML page. html/template
+// escapes every name and email.
+func printHTML(w io.Writer, trees []*filetree.Node, opts renderOptions) error {
+	// Colors and shares come from the page's own bars, so text is rendered
+	// without escape codes or text bars
+	htmlOpts := opts
+	htmlOpts.color = false
+	htmlOpts.barWidth = 0
+	funcs := template.FuncMap{
+		"color": func(percentage float64) string {
+			if color, ok := ruleColor(percentage, opts.colorRules); ok {
+				return color.hex()
+			}
+			return "#cccccc"
+		},
+		"suffix": func(n *filetree.Node) string {
+			return strings.TrimSpace(nodeSuffix(n, htmlOpts))
+		},
+		"author": func(stat filetree.AuthorStat) string {
+			return formatAuthor(stat, fmt.Sprintf("%.1f%%", stat.Percentage), htmlOpts)
+		},
+	}
+	tmpl, err := template.New("report").Funcs(funcs).Parse(htmlTemplate)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, struct{ Trees []*filetree.Node }{trees})
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"filetree"
+)
+
+// runMainEnv, when set, makes the test binary run main instead of the tests,
+// so tests can invoke filetree as a separate process.
+const runMainEnv = "FILETREE_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// result is the outcome of one filetree invocation.
+type result struct {
+	stdout, stderr string
+	code           int
+}
+
+// run invokes filetree with args from dir, feeding it stdin, with the
+// user's git configuration and cache out of the way.
+func run(t *testing.T, dir, stdin string, args ...string) result {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Env = append(os.Environ(),
+		runMainEnv+"=1",
+		"GIT_CONFIG_GLOBAL="+os.DevNull,
+		"GIT_CONFIG_NOSYSTEM=1",
+		"XDG_CONFIG_HOME="+t.TempDir(),
+		"XDG_CACHE_HOME="+t.TempDir(),
+		"NO_COLOR=",
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatal(err)
+	}
+	return result{stdout: stdout.String(), stderr: stderr.String(), code: cmd.ProcessState.ExitCode()}
+}
+
+// newRepo returns a repository in which alice committed src/main.go,
+// README.md and .filetree.toml and bob then committed docs/guide.md and a line
+// of src/main.go. The test is skipped if git isn't installed.
+func newRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	git := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_CONFIG_GLOBAL="+os.DevNull, "GIT_CONFIG_NOSYSTEM=1")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, output)
+		}
+	}
+	commit := func(name string, files map[string]string) {
+		writeFiles(t, dir, files)
+		git("add", "-A")
+		git("-c", "user.name="+name, "-c", "user.email="+name+"@x.org", "commit", "-q", "-m", "commit by "+name)
+	}
+	git("init", "-q")
+	commit("alice", map[string]string{
+		"src/main.go":       "1\n2\n3\n",
+		"README.md":         "r\n",
+		filetree.ConfigFile: "show_files = true\nexclude = [\"*.md\"]\n",
+	})
+	commit("bob", map[string]string{"docs/guide.md": "g\n", "src/main.go": "1\n2\n3\n4\n"})
+	return dir
+}
+
+// writeFiles writes files, keyed by slash-separated paths relative to dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCLI(t *testing.T) {
+	repo := newRepo(t)
+	tests := []struct {
+		name     string
+		args     []string
+		code     int
+		stdout   []string
+		unwanted []string
+		stderr   string
+	}{
+		{
+			name:     "config defaults",
+			stdout:   []string{"main.go (4 lines)", "alice@x.org (75.0%)", "bob@x.org (25.0%)"},
+			unwanted: []string{"README.md", "guide.md", "\033["},
+		},
+		{
+			name:   "flags replace config",
+			args:   []string{"--files=false", "--exclude", "src/"},
+			stdout: []string{"docs (1 file, 1 line)", "└── bob@x.org (100.0%)"},
+		},
+		{
+			name:   "positional root",
+			args:   []string{"src"},
+			stdout: []string{"src\n├── alice@x.org (75.0%)\n"},
+		},
+		{
+			name:     "git dir hidden",
+			args:     []string{"--all", "--no-blame"},
+			stdout:   []string{filetree.ConfigFile},
+			unwanted: []string{".git"},
+		},
+		{
+			name:   "git dir included",
+			args:   []string{"--all", "--no-blame", "--include-git"},
+			stdout: []string{".git", "HEAD"},
+		},
+		{
+			name:     "exclude",
+			args:     []string{"--exclude", "src/", "--exclude", "README.md"},
+			stdout:   []string{"guide.md (1 line)"},
+			unwanted: []string{"src", "README.md"},
+		},
+		{
+			name:     "include only",
+			args:     []string{"--exclude", "nothing", "--include-only", "*.md"},
+			stdout:   []string{"README.md", "guide.md"},
+			unwanted: []string{"main.go"},
+		},
+		{
+			name:   "color",
+			args:   []string{"--color=always"},
+			stdout: []string{"\033[32m75.0%\033[0m"},
+		},
+		{
+			name:     "no color wins",
+			args:     []string{"--color=always", "--no-color"},
+			unwanted: []string{"\033["},
+		},
+		{
+			name:     "depth",
+			args:     []string{"--depth", "1", "--exclude", "nothing"},
+			stdout:   []string{"├── docs", "├── src", "└── README.md (1 line)"},
+			unwanted: []string{"main.go", "guide.md"},
+		},
+		{name: "bad metric", args: []string{"--metric", "words"}, code: exitUsage, stderr: "invalid metric"},
+		{name: "bad date", args: []string{"--since", "last week"}, code: exitUsage, stderr: "invalid date"},
+		{name: "bad sort", args: []string{"--sort", "size-desc"}, code: exitUsage, stderr: "invalid sort order"},
+		{name: "missing root", args: []string{"missing"}, code: exitFailure, stderr: "Skipping missing:"},
+		{
+			name:     "ascii",
+			args:     []string{"--ascii"},
+			stdout:   []string{"`-- src", "|-- alice@x.org"},
+			unwanted: []string{"└"},
+		},
+		{name: "too many files", args: []string{"--max-files", "2", "--exclude", "nothing"}, code: exitFailure, stderr: "raise --max-files"},
+		{name: "bad format", args: []string{"--format", "yaml"}, code: exitUsage, stderr: `invalid format "yaml"`},
+		{
+			name:   "list files",
+			args:   []string{"--list-files", "--exclude", "nothing"},
+			stdout: []string{"docs/guide.md\nsrc/main.go\nREADME.md\n"},
+		},
+		{
+			name:     "list files to a depth",
+			args:     []string{"--list-files", "--exclude", "nothing", "--depth", "1"},
+			stdout:   []string{"README.md\n"},
+			unwanted: []string{"main.go", "guide.md"},
+		},
+		{
+			name:     "strip domain",
+			args:     []string{"--strip-domain"},
+			stdout:   []string{"alice (75.0%)", "bob (25.0%)"},
+			unwanted: []string{"@x.org"},
+		},
+		{name: "version", args: []string{"--version"}, stdout: []string{"filetree dev (commit none, built unknown)"}},
+		{name: "bash completion", args: []string{"completion", "bash"}, stdout: []string{"complete -o filenames -F _filetree filetree", "--depth"}},
+		{name: "zsh completion", args: []string{"completion", "zsh"}, stdout: []string{"#compdef filetree", "--depth"}},
+		{name: "fish completion", args: []string{"completion", "fish"}, stdout: []string{"complete -c filetree -l depth"}},
+		{name: "unknown shell", args: []string{"completion", "tcsh"}, code: exitUsage, stderr: `unsupported shell "tcsh"`},
+		{name: "bad ref", args: []string{"--ref", "no-such-branch"}, code: exitUsage, stderr: "no-such-branch"},
+		{name: "unknown theme", args: []string{"--theme", "neon"}, code: exitUsage, stderr: `unknown theme "neon" (want default)`},
+		{
+			name:     "summary only",
+			args:     []string{"--summary-only", "--bus-factor"},
+			stdout:   []string{"Summary: 1 file, 4 lines", "└── bob@x.org (25.0%)"},
+			unwanted: []string{"main.go", "Sole owners"},
+		},
+		{name: "summary only csv", args: []string{"--summary-only", "--format", "csv"}, code: exitUsage, stderr: "--summary-only needs text or json output"},
+		{name: "missing config", args: []string{"--config", "nope.toml"}, code: exitUsage, stderr: "nope.toml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := run(t, repo, "", tt.args...)
+			if res.code != tt.code {
+				t.Fatalf("exit code %d, want %d; stderr:\n%s", res.code, tt.code, res.stderr)
+			}
+			for _, want := range tt.stdout {
+				if !strings.Contains(res.stdout, want) {
+					t.Errorf("stdout lacks %q:\n%s", want, res.stdout)
+				}
+			}
+			for _, unwanted := range tt.unwanted {
+				if strings.Contains(res.stdout, unwanted) {
+					t.Errorf("stdout has %q:\n%s", unwanted, res.stdout)
+				}
+			}
+			if tt.stderr != "" && !strings.Contains(res.stderr, tt.stderr) {
+				t.Errorf("stderr lacks %q:\n%s", tt.stderr, res.stderr)
+			}
+			if tt.code != 0 && res.stdout != "" {
+				t.Errorf("failure wrote to stdout:\n%s", res.stdout)
+			}
+		})
+	}
+}
+
+func TestCLIOutsideRepo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "a\n"})
+
+	res := run(t, dir, "")
+	if res.code != exitFailure || !strings.Contains(res.stderr, "not inside a git work tree") || !strings.Contains(res.stderr, "--no-blame") {
+		t.Errorf("exit code %d, stderr %q; want a failure suggesting --no-blame", res.code, res.stderr)
+	}
+	res = run(t, dir, "", "--no-blame", "--files")
+	if res.code != 0 || !strings.Contains(res.stdout, "a.txt") {
+		t.Errorf("--no-blame: exit code %d, stdout %q, stderr %q", res.code, res.stdout, res.stderr)
+	}
+}
+
+func TestCLINoBlameWithoutGit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the git stand-in is a shell script")
+	}
+	repo := newRepo(t)
+	excludes := filepath.Join(t.TempDir(), "ignore")
+	writeFiles(t, filepath.Dir(excludes), map[string]string{"ignore": "*.tmp\n"})
+	writeFiles(t, repo, map[string]string{
+		".gitignore":  "/src/skip.go\n",
+		"src/skip.go": "s\n",
+		"src/a.tmp":   "t\n",
+	})
+	config := exec.Command("git", "config", "core.excludesFile", excludes)
+	config.Dir = repo
+	if output, err := config.CombinedOutput(); err != nil {
+		t.Fatalf("git config: %v\n%s", err, output)
+	}
+
+	// A git that records being run stands in for the real one
+	bin := t.TempDir()
+	calls := filepath.Join(bin, "calls")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$*\" >> %q\nexit 1\n", calls)
+	if err := os.WriteFile(filepath.Join(bin, "git"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+
+	// Patterns from the repository root and core.excludesFile still apply
+	// to a subdirectory
+	res := run(t, filepath.Join(repo, "src"), "", "--no-blame", "--files")
+	if res.code != 0 || !strings.Contains(res.stdout, "main.go") {
+		t.Errorf("exit code %d, stdout %q, stderr %q", res.code, res.stdout, res.stderr)
+	}
+	for _, unwanted := range []string{"skip.go", "a.tmp"} {
+		if strings.Contains(res.stdout, unwanted) {
+			t.Errorf("stdout has %q:\n%s", unwanted, res.stdout)
+		}
+	}
+	if data, err := os.ReadFile(calls); err == nil {
+		t.Errorf("git was run:\n%s", data)
+	}
+}
+
+func TestCLIBlameWithoutGit(t *testing.T) {
+	repo := newRepo(t)
+	t.Setenv("PATH", t.TempDir())
+
+	res := run(t, repo, "")
+	if res.code != 0 || !strings.Contains(res.stdout, "alice@x.org") {
+		t.Errorf("exit code %d, stdout %q, stderr %q; want go-git blame", res.code, res.stdout, res.stderr)
+	}
+	for _, tt := range []struct {
+		args   []string
+		stderr string
+	}{
+		{[]string{"--ignore-whitespace"}, "install git or use --no-blame"},
+		{[]string{"--blame-backend", "git"}, "git is required for blame"},
+	} {
+		res := run(t, repo, "", tt.args...)
+		if res.code != exitFailure || !strings.Contains(res.stderr, tt.stderr) {
+			t.Errorf("%q: exit code %d, stderr %q; want a failure mentioning %q", tt.args, res.code, res.stderr, tt.stderr)
+		}
+	}
+}
+
+func TestCLIConfigFile(t *testing.T) {
+	repo := newRepo(t)
+	config := filepath.Join(t.TempDir(), "other.toml")
+	writeFiles(t, filepath.Dir(config), map[string]string{"other.toml": "ignore = [\"src/\"]\n"})
+
+	// --config replaces the root's .filetree.toml, so README.md is no longer
+	// excluded and files are no longer shown
+	res := run(t, repo, "", "--config", config, "--all")
+	if res.code != 0 {
+		t.Fatalf("exit code %d: %s", res.code, res.stderr)
+	}
+	if strings.Contains(res.stdout, "src") || strings.Contains(res.stdout, "README.md") || !strings.Contains(res.stdout, "docs (1 file, 1 line)") {
+		t.Errorf("stdout:\n%s", res.stdout)
+	}
+}
+
+func TestCLIIgnoreGenerated(t *testing.T) {
+	repo := newRepo(t)
+	writeFiles(t, repo, map[string]string{"src/api.pb.go": "p\n", "go.sum": "s\n"})
+	config := filepath.Join(t.TempDir(), "other.toml")
+	writeFiles(t, filepath.Dir(config), map[string]string{"other.toml": "show_files = true\ngenerated = [\"*.sum\"]\n"})
+
+	tests := []struct {
+		name     string
+		args     []string
+		stdout   []string
+		unwanted []string
+	}{
+		{"kept by default", nil, []string{"api.pb.go", "go.sum", "main.go"}, nil},
+		{"ignored", []string{"--ignore-generated"}, []string{"main.go"}, []string{"api.pb.go", "go.sum"}},
+		{"config list", []string{"--ignore-generated", "--config", config}, []string{"api.pb.go", "main.go"}, []string{"go.sum"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := run(t, repo, "", append([]string{"--no-blame", "--exclude", "nothing"}, tt.args...)...)
+			if res.code != 0 {
+				t.Fatalf("exit code %d: %s", res.code, res.stderr)
+			}
+			for _, want := range tt.stdout {
+				if !strings.Contains(res.stdout, want) {
+					t.Errorf("stdout lacks %q:\n%s", want, res.stdout)
+				}
+			}
+			for _, unwanted := range tt.unwanted {
+				if strings.Contains(res.stdout, unwanted) {
+					t.Errorf("stdout has %q:\n%s", unwanted, res.stdout)
+				}
+			}
+		})
+	}
+}
+
+func TestCLIOutputFile(t *testing.T) {
+	repo := newRepo(t)
+	tests := []struct {
+		file  string
+		args  []string
+		check func(t *testing.T, data []byte)
+	}{
+		{"tree.json", nil, func(t *testing.T, data []byte) {
+			var tree struct {
+				Name     string `json:"name"`
+				Children []any  `json:"children"`
+			}
+			if err := json.Unmarshal(data, &tree); err != nil || tree.Name != filepath.Base(repo) || len(tree.Children) != 2 {
+				t.Errorf("tree %+v, error %v", tree, err)
+			}
+		}},
+		{"tree.txt", []string{"--color=auto"}, func(t *testing.T, data []byte) {
+			if bytes.Contains(data, []byte("\033[")) || !bytes.Contains(data, []byte("main.go")) {
+				t.Errorf("text output:\n%s", data)
+			}
+		}},
+		{"tree.csv", []string{"--format", "tsv"}, func(t *testing.T, data []byte) {
+			if !bytes.HasPrefix(data, []byte("path\temail\tlines\tpercentage\n")) {
+				t.Errorf("--format should win over the extension:\n%s", data)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			res := run(t, repo, "", append(tt.args, "--output", path)...)
+			if res.code != 0 || res.stdout != "" {
+				t.Fatalf("exit code %d, stdout %q, stderr %q", res.code, res.stdout, res.stderr)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, data)
+		})
+	}
+}
+
+func TestCLIMultipleRoots(t *testing.T) {
+	repo := newRepo(t)
+	res := run(t, repo, "", "--format", "ndjson", "--exclude", "nothing", "src", "docs")
+	if res.code != 0 {
+		t.Fatalf("exit code %d: %s", res.code, res.stderr)
+	}
+	var paths []string
+	for _, line := range strings.Split(strings.TrimSuffix(res.stdout, "\n"), "\n") {
+		var file struct {
+			Path    string `json:"path"`
+			Authors []any  `json:"authors"`
+		}
+		if err := json.Unmarshal([]byte(line), &file); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		paths = append(paths, file.Path)
+	}
+	if got := strings.Join(paths, ","); got != "src/main.go,docs/guide.md" {
+		t.Errorf("ndjson paths %s, want src/main.go,docs/guide.md", got)
+	}
+
+	res = run(t, repo, "", "--files=false", "src", "docs")
+	if !strings.HasPrefix(res.stdout, "src\n") || !strings.Contains(res.stdout, "\n\ndocs\n") {
+		t.Errorf("text output:\n%s", res.stdout)
+	}
+}
+
+func TestCLIFromStdin(t *testing.T) {
+	repo := newRepo(t)
+	res := run(t, repo, "src/main.go\n\ndocs/guide.md\n", "--from-stdin")
+	if res.code != 0 {
+		t.Fatalf("exit code %d: %s", res.code, res.stderr)
+	}
+	for _, want := range []string{"(stdin)", "src/main.go (4 lines)", "docs/guide.md (1 line)"} {
+		if !strings.Contains(res.stdout, want) {
+			t.Errorf("stdout lacks %q:\n%s", want, res.stdout)
+		}
+	}
+	if res := run(t, repo, "", "--from-stdin", "src"); res.code != exitUsage {
+		t.Errorf("--from-stdin with a directory: exit code %d, want %d", res.code, exitUsage)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"filetree"
+)
+
+// Output formats accepted by --format.
+const (
+	formatText     = "text"
+	formatJSON     = "json"
+	formatMarkdown = "markdown"
+	formatCSV      = "csv"
+	formatDOT      = "dot"
+	formatHTML     = "html"
+	formatTSV      = "tsv"
+	formatNDJSON   = "ndjson"
+)
+
+var formats = []string{formatText, formatJSON, formatMarkdown, formatCSV, formatTSV, formatDOT, formatHTML, formatNDJSON}
+
+func validFormat(format string) bool {
+	return slices.Contains(formats, format)
+}
+
+// extensionFormats maps --output file extensions to the format they imply.
+var extensionFormats = map[string]string{
+	".txt":    formatText,
+	".json":   formatJSON,
+	".md":     formatMarkdown,
+	".csv":    formatCSV,
+	".tsv":    formatTSV,
+	".dot":    formatDOT,
+	".gv":     formatDOT,
+	".html":   formatHTML,
+	".htm":    formatHTML,
+	".ndjson": formatNDJSON,
+	".jsonl":  formatNDJSON,
+}
+
+// formatForFile returns the format implied by the extension of path, if
+// any.
+func formatForFile(path string) (string, bool) {
+	format, ok := extensionFormats[strings.ToLower(filepath.Ext(path))]
+	return format, ok
+}
+
+// writeOutput writes trees, one per root, to w in the given format.
+func writeOutput(w io.Writer, format string, trees []*filetree.Node, opts renderOptions) error {
+	// Escape codes only make sense in a text tree shown in a terminal
+	if format != formatText {
+		opts.color = false
+	}
+	switch format {
+	case formatJSON:
+		if opts.summaryOnly {
+			return printJSONSummaries(w, trees)
+		}
+		return printJSON(w, trees)
+	case formatCSV:
+		return printCSV(w, trees)
+	case formatTSV:
+		return printTSV(w, trees)
+	case formatDOT:
+		printDOT(w, trees, opts)
+		return nil
+	case formatHTML:
+		return printHTML(w, trees, opts)
+	case formatNDJSON:
+		// Every file was already written as it finished blaming
+		return nil
+	}
+
+	for i, tree := range trees {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		switch {
+		case opts.summaryOnly:
+			fmt.Fprint(w, tree.Name)
+			printSummary(w, *tree.Summary, opts)
+		case format == formatMarkdown:
+			printMarkdown(w, tree, opts)
+		case opts.byExtension:
+			printExtensions(w, tree, opts)
+		default:
+			printTree(w, tree, opts)
+		}
+	}
+	return nil
+}
+
+// printJSON writes trees to w as an indented JSON document: the tree itself
+// for a single root, otherwise an array of trees.
+func printJSON(w io.Writer, trees []*filetree.Node) error {
+	var doc any = trees
+	if len(trees) == 1 {
+		doc = trees[0]
+	}
+	return writeJSON(w, doc)
+}
+
+// jsonSummary is a root's summary in --summary-only JSON output.
+type jsonSummary struct {
+	Name string `json:"name"`
+	filetree.Summary
+}
+
+// printJSONSummaries writes the summary of each of trees to w in place of
+// the trees, as printJSON lays them out.
+func printJSONSummaries(w io.Writer, trees []*filetree.Node) error {
+	if len(trees) == 1 {
+		return writeJSON(w, trees[0].Summary)
+	}
+	summaries := make([]jsonSummary, len(trees))
+	for i, tree := range trees {
+		summaries[i] = jsonSummary{Name: tree.Name, Summary: *tree.Summary}
+	}
+	return writeJSON(w, summaries)
+}
+
+// writeJSON writes doc to w as indented JSON.
+func writeJSON(w io.Writer, doc any) error {
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// ndjsonFile is one line of --format=ndjson output.
+type ndjsonFile struct {
+	Path    string                `json:"path"`
+	Authors []filetree.AuthorStat `json:"authors"`
+}
+
+// writeNDJSONFile writes one file's stats to w as a single line of JSON,
+// with a single Write so lines from concurrent callers never interleave.
+func writeNDJSONFile(w io.Writer, path string, authors []filetree.AuthorStat) error {
+	if authors == nil {
+		authors = []filetree.AuthorStat{}
+	}
+	data, err := json.Marshal(ndjsonFile{Path: path, Authors: authors})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// printMarkdown writes the tree rooted at n to w as a nested Markdown list,
+// with names as code spans, author stats as sub-items and percentages in
+// bold.
+func printMarkdown(w io.Writer, n *filetree.Node, opts renderOptions) {
+	printMarkdownNode(w, n, "", opts)
+}
+
+func printMarkdownNode(w io.Writer, n *filetree.Node, indent string, opts renderOptions) {
+	name := n.Name
+	if n.Type == filetree.NodeDir {
+		name += "/"
+	}
+	fmt.Fprintf(w, "%s- %s%s\n", indent, markdownCode(name), nodeSuffix(n, opts))
+
+	for _, child := range n.Children {
+		printMarkdownNode(w, child, indent+"  ", opts)
+	}
+	for _, stat := range n.Authors {
+		percentage := fmt.Sprintf("**%.1f%%**", stat.Percentage)
+		fmt.Fprintf(w, "%s  - %s\n", indent, formatAuthor(stat, percentage, opts))
+	}
+}
+
+// markdownCode returns s as a Markdown code span. The span is delimited by
+// one more backtick than the longest run of backticks in s, and padded with
+// spaces when s starts or ends with one, so any name renders verbatim.
+func markdownCode(s string) string {
+	longest, run := 0, 0
+	for _, r := range s {
+		if r == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	fence := strings.Repeat("`", longest+1)
+	if strings.HasPrefix(s, "`") || strings.HasSuffix(s, "`") {
+		s = " " + s + " "
+	}
+	return fence + s + fence
+}
+
+// ownershipRow is one node/author pair in the flat CSV projection of a tree.
+type ownershipRow struct {
+	path string
+	stat filetree.AuthorStat
+}
+
+// ownershipRows flattens the tree rooted at n into one row per author of
+// every node that carries stats: files when they are shown, otherwise
+// directories. Paths are relative to the root, which is root.
+func ownershipRows(n *filetree.Node, root string) []ownershipRow {
+	var rows []ownershipRow
+	var visit func(n *filetree.Node, nodePath string)
+	visit = func(n *filetree.Node, nodePath string) {
+		for _, stat := range n.Authors {
+			rows = append(rows, ownershipRow{path: nodePath, stat: stat})
+		}
+		for _, child := range n.Children {
+			childPath := path.Join(nodePath, child.Name)
+			if child.Type == filetree.NodeDir {
+				childPath += "/"
+			}
+			visit(child, childPath)
+		}
+	}
+	visit(n, root)
+	return rows
+}
+
+// ownershipHeader names the columns of ownershipRecords.
+var ownershipHeader = []string{"path", "email", "lines", "percentage"}
+
+// ownershipRecords returns a path, email, lines, percentage record for every
+// node/author pair in trees. With several roots, paths start with the root's
+// name.
+func ownershipRecords(trees []*filetree.Node) [][]string {
+	var records [][]string
+	for _, tree := range trees {
+		root := "."
+		if len(trees) > 1 {
+			root = tree.Name + "/"
+		}
+		for _, row := range ownershipRows(tree, root) {
+			email := row.stat.Email
+			if row.stat.Others {
+				email = "(others)"
+			}
+			records = append(records, []string{
+				row.path,
+				email,
+				strconv.Itoa(row.stat.Count),
+				strconv.FormatFloat(row.stat.Percentage, 'f', 1, 64),
+			})
+		}
+	}
+	return records
+}
+
+// printCSV writes the ownership records for trees as CSV, after a header row.
+func printCSV(w io.Writer, trees []*filetree.Node) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(ownershipHeader); err != nil {
+		return err
+	}
+	if err := cw.WriteAll(ownershipRecords(trees)); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+// tsvEscaper escapes the characters that would break a TSV field.
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// printTSV writes the ownership records for trees as tab-separated values,
+// after a header row. Tabs, newlines and backslashes in fields are escaped
+// with backslashes.
+func printTSV(w io.Writer, trees []*filetree.Node) error {
+	records := append([][]string{ownershipHeader}, ownershipRecords(trees)...)
+	for _, record := range records {
+		fields := make([]string, len(record))
+		for i, field := range record {
+			fields[i] = tsvEscaper.Replace(field)
+		}
+		if _, err := fmt.Fprintln(w, strings.Join(fields, "\t")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printDOT writes trees to w as a Graphviz digraph with one node per
+// directory and file and an edge from each directory to its children. Nodes
+// are filled with the ownership color of their top author.
+func printDOT(w io.Writer, trees []*filetree.Node, opts renderOptions) {
+	fmt.Fprintln(w, "digraph filetree {")
+	fmt.Fprintln(w, `  node [shape=box, style=filled, fillcolor="#ffffff"];`)
+
+	id := 0
+	var visit func(n *filetree.Node) string
+	visit = func(n *filetree.Node) string {
+		nodeID := fmt.Sprintf("n%d", id)
+		id++
+
+		lines := []string{n.Name}
+		if n.Type == filetree.NodeDir {
+			lines[0] += "/"
+		}
+		attrs := ""
+		if top, ok := topAuthor(n); ok {
+			lines = append(lines, opts.displayEmail(top.Email), fmt.Sprintf("%.1f%%", top.Percentage))
+			if color, ok := ruleColor(top.Percentage, opts.colorRules); ok {
+				attrs = fmt.Sprintf(`, fillcolor="%s"`, color.hex())
+			}
+		}
+		fmt.Fprintf(w, "  %s [label=%s%s];\n", nodeID, dotLabel(lines), attrs)
+
+		for _, child := range n.Children {
+			childID := visit(child)
+			fmt.Fprintf(w, "  %s -> %s;\n", nodeID, childID)
+		}
+		return nodeID
+	}
+	for _, tree := range trees {
+		visit(tree)
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// topAuthor returns the author with the largest share of n, ignoring any
+// Others entry.
+func topAuthor(n *filetree.Node) (filetree.AuthorStat, bool) {
+	var top filetree.AuthorStat
+	found := false
+	for _, stat := range n.Authors {
+		if !stat.Others && (!found || stat.Percentage > top.Percentage) {
+			top, found = stat, true
+		}
+	}
+	return top, found
+}
+
+// dotLabel quotes lines as a multi-line DOT label.
+func dotLabel(lines []string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	for i, line := range lines {
+		lines[i] = escaper.Replace(line)
+	}
+	return `"` + strings.Join(lines, `\n`) + `"`
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"filetree"
+)
+
+// sampleTree returns a small tree as walked with --files:
+//
+//	proj
+//	├── src
+//	│   ├── main.go   alice 6, bob 2
+//	│   └── a,b.go    bob 3
+//	└── README.md     alice 1
+func sampleTree() *filetree.Node {
+	modified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &filetree.Node{
+		Name: "proj",
+		Type: filetree.NodeDir,
+		Children: []*filetree.Node{
+			{
+				Name: "src",
+				Type: filetree.NodeDir,
+				Children: []*filetree.Node{
+					{
+						Name: "main.go", Type: filetree.NodeFile, Total: 8, Size: 2048, Modified: &modified,
+						Authors: []filetree.AuthorStat{
+							{Name: "Alice", Email: "alice@x.org", Count: 6, Percentage: 75},
+							{Name: "Bob", Email: "bob@x.org", Count: 2, Percentage: 25},
+						},
+					},
+					{
+						Name: "a,b.go", Type: filetree.NodeFile, Total: 3, Size: 12, SoleOwner: true,
+						Authors: []filetree.AuthorStat{{Name: "Bob", Email: "bob@x.org", Count: 3, Percentage: 100}},
+					},
+				},
+			},
+			{
+				Name: "README.md", Type: filetree.NodeFile, Total: 1, Size: 3,
+				Authors: []filetree.AuthorStat{{Name: "Alice", Email: "alice@x.org", Count: 1, Percentage: 100}},
+			},
+		},
+		Summary: &filetree.Summary{
+			Files: 3,
+			Total: 12,
+			Authors: []filetree.AuthorStat{
+				{Name: "Alice", Email: "alice@x.org", Count: 7, Percentage: 7.0 / 12 * 100},
+				{Name: "Bob", Email: "bob@x.org", Count: 5, Percentage: 5.0 / 12 * 100},
+			},
+			SoleOwned: []string{"src/a,b.go"},
+		},
+	}
+}
+
+// testRenderOptions are the render options of a plain filetree invocation
+// writing to a file.
+func testRenderOptions() renderOptions {
+	return renderOptions{
+		glyphs:     unicodeGlyphs,
+		colorRules: defaultColorRules,
+		lineCounts: true,
+		unit:       "line",
+		now:        time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+// render writes the sample tree in format with the test render options as
+// changed by configure.
+func render(t *testing.T, format string, configure func(*renderOptions)) string {
+	t.Helper()
+	opts := testRenderOptions()
+	if configure != nil {
+		configure(&opts)
+	}
+	tree := sampleTree()
+	if !opts.summaryOnly {
+		tree.Summary = nil
+	}
+	var b bytes.Buffer
+	if err := writeOutput(&b, format, []*filetree.Node{tree}, opts); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestWriteOutputText(t *testing.T) {
+	tests := []struct {
+		name      string
+		format    string
+		configure func(*renderOptions)
+		want      string
+	}{
+		{"tree", formatText, nil, `proj
+├── src
+│   ├── main.go (8 lines)
+│   │   ├── alice@x.org (75.0%)
+│   │   └── bob@x.org (25.0%)
+│   └── a,b.go (3 lines) [SOLE]
+│       └── bob@x.org (100.0%)
+└── README.md (1 line)
+    └── alice@x.org (100.0%)
+`},
+		{"names", formatText, func(o *renderOptions) { o.showNames = true }, `proj
+├── src
+│   ├── main.go (8 lines)
+│   │   ├── Alice <alice@x.org> (75.0%)
+│   │   └── Bob <bob@x.org> (25.0%)
+│   └── a,b.go (3 lines) [SOLE]
+│       └── Bob <bob@x.org> (100.0%)
+└── README.md (1 line)
+    └── Alice <alice@x.org> (100.0%)
+`},
+		{"no line counts", formatText, func(o *renderOptions) { o.lineCounts = false }, `proj
+├── src
+│   ├── main.go
+│   │   ├── alice@x.org (75.0%)
+│   │   └── bob@x.org (25.0%)
+│   └── a,b.go [SOLE]
+│       └── bob@x.org (100.0%)
+└── README.md
+    └── alice@x.org (100.0%)
+`},
+		{"sizes", formatText, func(o *renderOptions) { o.sizes = true }, `proj
+├── src
+│   ├── main.go (8 lines, 2.0 KB)
+│   │   ├── alice@x.org (75.0%)
+│   │   └── bob@x.org (25.0%)
+│   └── a,b.go (3 lines, 12 B) [SOLE]
+│       └── bob@x.org (100.0%)
+└── README.md (1 line, 3 B)
+    └── alice@x.org (100.0%)
+`},
+		{"sizes and ages", formatText, func(o *renderOptions) { o.sizes, o.ages = true, true }, `proj
+├── src
+│   ├── main.go (8 lines, 2.0 KB, 3mo ago)
+│   │   ├── alice@x.org (75.0%)
+│   │   └── bob@x.org (25.0%)
+│   └── a,b.go (3 lines, 12 B) [SOLE]
+│       └── bob@x.org (100.0%)
+└── README.md (1 line, 3 B)
+    └── alice@x.org (100.0%)
+`},
+		{"ascii", formatText, func(o *renderOptions) { o.glyphs = asciiGlyphs }, "proj\n" +
+			"|-- src\n" +
+			"|   |-- main.go (8 lines)\n" +
+			"|   |   |-- alice@x.org (75.0%)\n" +
+			"|   |   `-- bob@x.org (25.0%)\n" +
+			"|   `-- a,b.go (3 lines) [SOLE]\n" +
+			"|       `-- bob@x.org (100.0%)\n" +
+			"`-- README.md (1 line)\n" +
+			"    `-- alice@x.org (100.0%)\n"},
+		{"markdown", formatMarkdown, nil, "- `proj/`\n  - `src/`\n    - `main.go` (8 lines)\n      - alice@x.org (**75.0%**)\n      - bob@x.org (**25.0%**)\n    - `a,b.go` (3 lines) [SOLE]\n      - bob@x.org (**100.0%**)\n  - `README.md` (1 line)\n    - alice@x.org (**100.0%**)\n"},
+		{"csv", formatCSV, nil, `path,email,lines,percentage
+src/main.go,alice@x.org,6,75.0
+src/main.go,bob@x.org,2,25.0
+"src/a,b.go",bob@x.org,3,100.0
+README.md,alice@x.org,1,100.0
+`},
+		{"dot", formatDOT, nil, `digraph filetree {
+  node [shape=box, style=filled, fillcolor="#ffffff"];
+  n0 [label="proj/"];
+  n1 [label="src/"];
+  n2 [label="main.go\nalice@x.org\n75.0%", fillcolor="#008000"];
+  n1 -> n2;
+  n3 [label="a,b.go\nbob@x.org\n100.0%", fillcolor="#ff5faf"];
+  n1 -> n3;
+  n0 -> n1;
+  n4 [label="README.md\nalice@x.org\n100.0%", fillcolor="#ff5faf"];
+  n0 -> n4;
+}
+`},
+		{"tsv", formatTSV, nil, `path	email	lines	percentage
+src/main.go	alice@x.org	6	75.0
+src/main.go	bob@x.org	2	25.0
+src/a,b.go	bob@x.org	3	100.0
+README.md	alice@x.org	1	100.0
+`},
+		{"ndjson", formatNDJSON, nil, ""},
+		{"compact", formatText, func(o *renderOptions) { o.compact = true }, `proj
+├── src
+│   ├── main.go (8 lines): alice@x.org 75.0% bob@x.org 25.0%
+│   └── a,b.go (3 lines) [SOLE]: bob@x.org 100.0%
+└── README.md (1 line): alice@x.org 100.0%
+`},
+		{"owner only", formatText, func(o *renderOptions) { o.ownerOnly = true }, `proj
+├── src
+│   ├── main.go (8 lines): alice@x.org 75.0%
+│   └── a,b.go (3 lines) [SOLE]: bob@x.org 100.0%
+└── README.md (1 line): alice@x.org 100.0%
+`},
+		{"bars", formatText, func(o *renderOptions) { o.barWidth = 4 }, `proj
+├── src
+│   ├── main.go (8 lines)
+│   │   ├── alice@x.org ███░ (75.0%)
+│   │   └── bob@x.org █░░░ (25.0%)
+│   └── a,b.go (3 lines) [SOLE]
+│       └── bob@x.org ████ (100.0%)
+└── README.md (1 line)
+    └── alice@x.org ████ (100.0%)
+`},
+		{"summary only", formatText, func(o *renderOptions) { o.summaryOnly = true }, `proj
+Summary: 3 files, 12 lines
+├── alice@x.org (58.3%)
+└── bob@x.org (41.7%)
+
+Sole owners: 1 file
+└── src/a,b.go
+`},
+		{"strip", formatText, func(o *renderOptions) { o.stripEmail = []string{"@x.org"} }, `proj
+├── src
+│   ├── main.go (8 lines)
+│   │   ├── alice (75.0%)
+│   │   └── bob (25.0%)
+│   └── a,b.go (3 lines) [SOLE]
+│       └── bob (100.0%)
+└── README.md (1 line)
+    └── alice (100.0%)
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := render(t, tt.format, tt.configure); got != tt.want {
+				t.Errorf("output:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteOutputTextDirectories(t *testing.T) {
+	// A tree walked without --files carries the counts on its directories
+	tree := &filetree.Node{Name: "proj", Type: filetree.NodeDir, Files: 3, Total: 12, Children: []*filetree.Node{
+		{
+			Name: "src", Type: filetree.NodeDir, Files: 2, Total: 11,
+			Authors: []filetree.AuthorStat{{Email: "alice@x.org", Count: 11, Percentage: 100}},
+		},
+		{
+			Name: "docs", Type: filetree.NodeDir, Files: 1, Total: 1,
+			Authors: []filetree.AuthorStat{{Email: "bob@x.org", Count: 1, Percentage: 100}},
+		},
+		{Name: "empty", Type: filetree.NodeDir},
+	}}
+	var b bytes.Buffer
+	if err := writeOutput(&b, formatText, []*filetree.Node{tree}, testRenderOptions()); err != nil {
+		t.Fatal(err)
+	}
+	want := `proj
+├── src (2 files, 11 lines)
+│   └── alice@x.org (100.0%)
+├── docs (1 file, 1 line)
+│   └── bob@x.org (100.0%)
+└── empty
+`
+	if got := b.String(); got != want {
+		t.Errorf("tree:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWriteOutputTextDeepNesting(t *testing.T) {
+	file := func(name string) *filetree.Node {
+		return &filetree.Node{
+			Name: name, Type: filetree.NodeFile, Total: 1,
+			Authors: []filetree.AuthorStat{{Email: "alice@x.org", Count: 1, Percentage: 100}},
+		}
+	}
+	dir := func(name string, children ...*filetree.Node) *filetree.Node {
+		return &filetree.Node{Name: name, Type: filetree.NodeDir, Children: children}
+	}
+	// Each level has a last and a non-last entry, with the directory first
+	// in some levels and last in others, so every guide column is exercised.
+	tree := dir("proj",
+		dir("a",
+			dir("b",
+				file("b.go"),
+				dir("c",
+					dir("d",
+						file("d1.go"),
+						file("d2.go"),
+					),
+					file("c.go"),
+				),
+			),
+			file("a.go"),
+		),
+		dir("z", file("z.go")),
+	)
+	var b bytes.Buffer
+	if err := writeOutput(&b, formatText, []*filetree.Node{tree}, testRenderOptions()); err != nil {
+		t.Fatal(err)
+	}
+	want := `proj
+├── a
+│   ├── b
+│   │   ├── b.go (1 line)
+│   │   │   └── alice@x.org (100.0%)
+│   │   └── c
+│   │       ├── d
+│   │       │   ├── d1.go (1 line)
+│   │       │   │   └── alice@x.org (100.0%)
+│   │       │   └── d2.go (1 line)
+│   │       │       └── alice@x.org (100.0%)
+│   │       └── c.go (1 line)
+│   │           └── alice@x.org (100.0%)
+│   └── a.go (1 line)
+│       └── alice@x.org (100.0%)
+└── z
+    └── z.go (1 line)
+        └── alice@x.org (100.0%)
+`
+	if got := b.String(); got != want {
+		t.Errorf("tree:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestPrintCSVRoundTrip(t *testing.T) {
+	records, err := csv.NewReader(strings.NewReader(render(t, formatCSV, nil))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 5 {
+		t.Fatalf("%d records, want a header and 4 rows", len(records))
+	}
+	// The comma in the file name stays within its field
+	if got := records[3]; got[0] != "src/a,b.go" || got[1] != "bob@x.org" || got[2] != "3" || got[3] != "100.0" {
+		t.Errorf("record %q", got)
+	}
+}
+
+func TestPrintTSVEscapes(t *testing.T) {
+	tree := &filetree.Node{Name: "root", Type: filetree.NodeDir, Children: []*filetree.Node{{
+		Name: "tab\there\\", Type: filetree.NodeFile,
+		Authors: []filetree.AuthorStat{{Email: "a@x.org", Count: 1, Percentage: 100}},
+	}}}
+	var b bytes.Buffer
+	if err := printTSV(&b, []*filetree.Node{tree}); err != nil {
+		t.Fatal(err)
+	}
+	want := "path\temail\tlines\tpercentage\ntab\\there\\\\\ta@x.org\t1\t100.0\n"
+	if got := b.String(); got != want {
+		t.Errorf("printTSV() = %q, want %q", got, want)
+	}
+}
+
+func TestPrintJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		trees   int
+		summary bool
+		check   func(t *testing.T, data []byte)
+	}{
+		{"one tree", 1, false, func(t *testing.T, data []byte) {
+			var tree filetree.Node
+			if err := json.Unmarshal(data, &tree); err != nil || tree.Name != "proj" || len(tree.Children) != 2 {
+				t.Errorf("tree %+v, error %v", tree, err)
+			}
+		}},
+		{"tree with summary", 1, false, func(t *testing.T, data []byte) {
+			var tree filetree.Node
+			if err := json.Unmarshal(data, &tree); err != nil || tree.Summary == nil || tree.Summary.Files != 3 || tree.Summary.Total != 12 {
+				t.Errorf("tree summary %+v, error %v", tree.Summary, err)
+			}
+		}},
+		{"two trees", 2, false, func(t *testing.T, data []byte) {
+			var trees []filetree.Node
+			if err := json.Unmarshal(data, &trees); err != nil || len(trees) != 2 {
+				t.Errorf("trees %+v, error %v", trees, err)
+			}
+		}},
+		{"one summary", 1, true, func(t *testing.T, data []byte) {
+			var s filetree.Summary
+			if err := json.Unmarshal(data, &s); err != nil || s.Files != 3 || s.Total != 12 || len(s.SoleOwned) != 1 {
+				t.Errorf("summary %+v, error %v", s, err)
+			}
+		}},
+		{"two summaries", 2, true, func(t *testing.T, data []byte) {
+			var s []jsonSummary
+			if err := json.Unmarshal(data, &s); err != nil || len(s) != 2 || s[0].Name != "proj" || s[1].Total != 12 {
+				t.Errorf("summaries %+v, error %v", s, err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var trees []*filetree.Node
+			for range tt.trees {
+				trees = append(trees, sampleTree())
+			}
+			opts := testRenderOptions()
+			opts.summaryOnly = tt.summary
+			var b bytes.Buffer
+			if err := writeOutput(&b, formatJSON, trees, opts); err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, b.Bytes())
+		})
+	}
+}
+
+func TestWriteNDJSONFile(t *testing.T) {
+	var b bytes.Buffer
+	writeNDJSONFile(&b, "src/main.go", sampleTree().Children[0].Children[0].Authors)
+	writeNDJSONFile(&b, "empty.go", nil)
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d lines, want 2", len(lines))
+	}
+	for i, want := range []int{2, 0} {
+		var file ndjsonFile
+		if err := json.Unmarshal([]byte(lines[i]), &file); err != nil {
+			t.Fatalf("line %d: %v", i+1, err)
+		}
+		if len(file.Authors) != want || file.Authors == nil {
+			t.Errorf("line %d: %+v, want %d authors", i+1, file, want)
+		}
+	}
+}
+
+func TestPrintHTML(t *testing.T) {
+	tree := sampleTree()
+	tree.Children[1].Name = "<script>.md"
+	var b bytes.Buffer
+	if err := printHTML(&b, []*filetree.Node{tree}, testRenderOptions()); err != nil {
+		t.Fatal(err)
+	}
+	page := b.String()
+	for _, want := range []string{
+		"<title>proj ownership</title>",
+		"<summary>src/</summary>",
+		"main.go <span class=\"note\">(8 lines)</span>",
+		"alice@x.org (75.0%)",
+		"&lt;script&gt;.md",
+		"width: 75.0%; background: #008000",
+		"width: 100.0%; background: #ff5faf",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page lacks %q", want)
+		}
+	}
+	if strings.Contains(page, "<script>") || strings.Count(page, "<details") != strings.Count(page, "</details>") {
+		t.Error("page has unescaped names or unbalanced elements")
+	}
+}
+
+func TestColorOutput(t *testing.T) {
+	mono, err := parseColorRules([]filetree.ColorRule{{Above: 0, Color: "#808080"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		configure func(*renderOptions)
+		contains  []string
+		excludes  []string
+	}{
+		{"off", nil, nil, []string{"\033["}},
+		{"default rules", func(o *renderOptions) { o.color = true }, []string{"\033[32m75.0%" + colorReset, "\033[38;5;51m25.0%", "\033[38;5;205m100.0%"}, nil},
+		{"theme", func(o *renderOptions) { o.color, o.colorRules = true, mono }, []string{"\033[38;2;128;128;128m75.0%"}, []string{"\033[32m", "\033[38;5;205m"}},
+		{"gradient", func(o *renderOptions) { o.color, o.gradient = true, true }, []string{"\033[38;2;128;255;0m75.0%"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := render(t, formatText, tt.configure)
+			for _, want := range tt.contains {
+				if !strings.Contains(got, want) {
+					t.Errorf("output lacks %q:\n%q", want, got)
+				}
+			}
+			for _, unwanted := range tt.excludes {
+				if strings.Contains(got, unwanted) {
+					t.Errorf("output has %q:\n%q", unwanted, got)
+				}
+			}
+		})
+	}
+}
+
+func TestASCIIOutput(t *testing.T) {
+	got := render(t, formatText, func(o *renderOptions) { o.glyphs, o.barWidth = asciiGlyphs, 5 })
+	for i := 0; i < len(got); i++ {
+		if got[i] > 0x7f {
+			t.Fatalf("byte %#x at offset %d in ASCII output:\n%s", got[i], i, got)
+		}
+	}
+}
+
+func TestUncoloredFormats(t *testing.T) {
+	for _, format := range formats {
+		if format == formatText {
+			continue
+		}
+		got := render(t, format, func(o *renderOptions) { o.color, o.barWidth = true, 5 })
+		if strings.Contains(got, "\033[") {
+			t.Errorf("%s output has escape codes:\n%q", format, got)
+		}
+	}
+}
+
+func TestMarkdownCode(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"main.go", "`main.go`"},
+		{"a`b.go", "``a`b.go``"},
+		{"x``y", "```x``y```"},
+		{"`edge`", "`` `edge` ``"},
+	}
+	for _, tt := range tests {
+		if got := markdownCode(tt.in); got != tt.want {
+			t.Errorf("markdownCode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"filetree"
+)
+
+// clearScreen moves the cursor home and clears the terminal.
+const clearScreen = "\033[H\033[2J"
+
+const (
+	// watchInterval is how often the roots are checked for changes
+	watchInterval = time.Second
+	// watchDebounce is how long the roots must stay unchanged after a
+	// change before the tree is redrawn, so a burst of writes redraws once
+	watchDebounce = 300 * time.Millisecond
+)
+
+// watchRoots calls render, then polls roots for changes until ctx is
+// cancelled, calling render again once each burst of changes settles. Along
+// with the files under the roots, the git index and HEAD are watched, since
+// committing changes attribution without touching the files. Files ignored
+// by the patterns returned for their root aren't watched; the patterns are
+// loaded again on every check, in case an ignore file was edited. A change
+// can take up to watchInterval to be noticed.
+func watchRoots(ctx context.Context, roots []string, patterns func(root string) []string, render func()) {
+	var extra []string
+	for _, root := range roots {
+		if dir, ok := filetree.GitDir(root); ok {
+			extra = append(extra, filepath.Join(dir, "index"), filepath.Join(dir, "HEAD"))
+		}
+	}
+
+	watchLoop(ctx, watchInterval, watchDebounce, func() uint64 {
+		rootPatterns := make(map[string][]string, len(roots))
+		for _, root := range roots {
+			rootPatterns[root] = patterns(root)
+		}
+		return fingerprint(roots, rootPatterns, extra)
+	}, render)
+}
+
+// watchLoop calls onChange, then checks fingerprint every interval until ctx
+// is cancelled. Once it changes, it must then hold still for debounce before
+// onChange is called again. Changes are measured against the fingerprint
+// taken before onChange last ran, so files changed while it runs, such as
+// during a slow render, are caught by the next check.
+func watchLoop(ctx context.Context, interval, debounce time.Duration, fingerprint func() uint64, onChange func()) {
+	last := fingerprint()
+	onChange()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := fingerprint()
+		if current == last {
+			continue
+		}
+		for settled := false; !settled; {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(debounce):
+			}
+			next := fingerprint()
+			settled = next == current
+			current = next
+		}
+		last = current
+		onChange()
+	}
+}
+
+// fingerprint hashes the name, size and modification time of every file
+// under roots, skipping .git directories and the paths matching the root's
+// patterns, and of the extra files. Entries that vanish mid-walk are simply
+// left out.
+func fingerprint(roots []string, patterns map[string][]string, extra []string) uint64 {
+	h := fnv.New64a()
+	for _, root := range roots {
+		filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			relPath, err := filepath.Rel(root, path)
+			if err == nil && entry.IsDir() {
+				relPath += "/"
+			}
+			if err == nil && relPath != "./" && filetree.MatchesGitignore(relPath, patterns[root]) {
+				if entry.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if entry.IsDir() && entry.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil
+			}
+			fmt.Fprintf(h, "%s\x00%d\x00%d\x00", path, info.Size(), info.ModTime().UnixNano())
+			return nil
+		})
+	}
+	for _, path := range extra {
+		if info, err := os.Stat(path); err == nil {
+			fmt.Fprintf(h, "%s\x00%d\x00%d\x00", path, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return h.Sum64()
+}
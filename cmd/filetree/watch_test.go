@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatchLoopDebounce(t *testing.T) {
+	const (
+		interval = 5 * time.Millisecond
+		debounce = 100 * time.Millisecond
+	)
+	var value atomic.Uint64
+	changes := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		watchLoop(ctx, interval, debounce, value.Load, func() { changes <- struct{}{} })
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	select {
+	case <-changes:
+	case <-time.After(5 * debounce):
+		t.Fatal("no initial draw")
+	}
+
+	// A burst of changes closer together than the debounce redraws once
+	for range 10 {
+		value.Add(1)
+		time.Sleep(interval)
+	}
+	select {
+	case <-changes:
+	case <-time.After(5 * debounce):
+		t.Fatal("no change reported after the burst")
+	}
+	select {
+	case <-changes:
+		t.Fatal("burst reported more than once")
+	case <-time.After(3 * debounce):
+	}
+
+	// A later change is reported again
+	value.Add(1)
+	select {
+	case <-changes:
+	case <-time.After(5 * debounce):
+		t.Fatal("no change reported after the burst settled")
+	}
+}
+
+func TestWatchLoopChangeWhileDrawing(t *testing.T) {
+	const (
+		interval = 5 * time.Millisecond
+		debounce = 20 * time.Millisecond
+	)
+	var value, draws atomic.Uint64
+	changes := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		watchLoop(ctx, interval, debounce, value.Load, func() {
+			// The redraw after the first change itself sees another change
+			if draws.Add(1) == 2 {
+				value.Add(1)
+			}
+			changes <- struct{}{}
+		})
+	}()
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	for draw := 1; draw <= 3; draw++ {
+		select {
+		case <-changes:
+		case <-time.After(50 * debounce):
+			t.Fatalf("draw %d never happened", draw)
+		}
+		if draw == 1 {
+			value.Add(1)
+		}
+	}
+}
+
+func TestFingerprintSkipsIgnored(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"main.go", "node_modules/dep/index.js", ".git/index"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	patterns := map[string][]string{root: {"node_modules/"}}
+	before := fingerprint([]string{root}, patterns, nil)
+
+	tests := []struct {
+		name    string
+		changed bool
+	}{
+		{"node_modules/dep/index.js", false},
+		{".git/index", false},
+		{"main.go", true},
+	}
+	later := time.Now().Add(time.Hour)
+	for _, tt := range tests {
+		if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(tt.name)), later, later); err != nil {
+			t.Fatal(err)
+		}
+		after := fingerprint([]string{root}, patterns, nil)
+		if changed := after != before; changed != tt.changed {
+			t.Errorf("touching %s: fingerprint changed = %v, want %v", tt.name, changed, tt.changed)
+		}
+		before = after
+	}
+}
@@ -0,0 +1,343 @@
+package filetree
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConfigFile is the name of the configuration file read from the walk root.
+const ConfigFile = ".filetree.toml"
+
+// Config is the contents of a .filetree.toml file. Fields left unset keep the
+// command line defaults.
+type Config struct {
+	// Ignore lists gitignore-style patterns excluded from the walk
+	Ignore []string
+	// Exclude, if non-empty, sets the default patterns for --exclude, which
+	// replace it when given
+	Exclude []string
+	// Generated, if non-empty, replaces GeneratedPatterns as the files
+	// --ignore-generated leaves out
+	Generated []string
+	// MaxDepth limits recursion like --depth; zero means unset
+	MaxDepth int
+	// ShowFiles, if non-nil, sets the default for --files
+	ShowFiles *bool
+	// Color is "auto", "always" or "never"; empty means unset
+	Color string
+	// Sort is the default for --sort; empty means unset
+	Sort string
+	// Top is the default for --top; zero means unset
+	Top int
+	// Threshold is the default for --threshold; zero means unset
+	Threshold float64
+	// BusFactorThreshold is the default for --bus-factor-threshold; zero
+	// means unset
+	BusFactorThreshold float64
+	// ColorRules, if non-empty, replaces the default percentage colors
+	ColorRules []ColorRule
+	// Themes holds named sets of color rules, selected with --theme
+	Themes map[string][]ColorRule
+	// Theme is the default for --theme; empty means unset
+	Theme string
+	// Extensions holds per-extension overrides keyed by extension, including
+	// the leading dot
+	Extensions map[string]ExtensionConfig
+
+	// badPatterns holds the malformed patterns left out of a flat list of
+	// patterns, for LoadIgnorePatterns to report
+	badPatterns []error
+}
+
+// ExtensionConfig overrides settings for files with a given extension.
+type ExtensionConfig struct {
+	// Ignore excludes files with the extension from the walk
+	Ignore bool
+}
+
+// ColorRule colors the percentages above a threshold. Rules are checked in
+// order and the first one a percentage exceeds applies, so they are usually
+// listed from the highest threshold down.
+type ColorRule struct {
+	// Above is the percentage that must be exceeded
+	Above float64
+	// Color is a color name, such as "pink", a 256-color palette number or
+	// a "#rrggbb" truecolor code
+	Color string
+}
+
+// LoadConfig reads the configuration file at path. A missing file yields an
+// empty Config. For backward compatibility, a file with no line that looks
+// like TOML, a key = value pair or a [table] header, is read as a flat list
+// of gitignore-style patterns; TOML that doesn't parse is an error.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, err
+	}
+
+	doc, err := parseTOML(string(data))
+	if err != nil {
+		if looksLikeTOML(string(data)) {
+			return nil, err
+		}
+		cfg := &Config{}
+		cfg.Ignore, err = loadGitignore(path, func(err error) {
+			cfg.badPatterns = append(cfg.badPatterns, err)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return cfg, nil
+	}
+	return decodeConfig(doc)
+}
+
+// IgnorePatterns returns the configured ignore patterns, followed by one
+// pattern for each ignored extension.
+func (c *Config) IgnorePatterns() []string {
+	patterns := append([]string(nil), c.Ignore...)
+
+	exts := make([]string, 0, len(c.Extensions))
+	for ext := range c.Extensions {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	for _, ext := range exts {
+		if c.Extensions[ext].Ignore {
+			patterns = append(patterns, "*"+ext)
+		}
+	}
+	return patterns
+}
+
+// tomlLine matches a line that can only be TOML, never a gitignore pattern
+// written out of habit: a key = value pair or a [table] header.
+var tomlLine = regexp.MustCompile(`^(?:[A-Za-z0-9_."-]+\s*=|\[\[?[A-Za-z0-9_."\s-]+\]\]?\s*(?:#.*)?$)`)
+
+// looksLikeTOML reports whether any line of data is TOML syntax.
+func looksLikeTOML(data string) bool {
+	for _, line := range strings.Split(data, "\n") {
+		if tomlLine.MatchString(strings.TrimSpace(line)) {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeConfig(doc map[string]any) (*Config, error) {
+	cfg := &Config{}
+	for key, value := range doc {
+		var err error
+		switch key {
+		case "ignore":
+			cfg.Ignore, err = configStrings(key, value)
+		case "exclude":
+			cfg.Exclude, err = configStrings(key, value)
+		case "generated":
+			cfg.Generated, err = configStrings(key, value)
+		case "max_depth", "depth":
+			cfg.MaxDepth, err = configInt(key, value)
+		case "show_files":
+			var showFiles bool
+			showFiles, err = configBool(key, value)
+			cfg.ShowFiles = &showFiles
+		case "color":
+			cfg.Color, err = configColor(key, value)
+		case "sort":
+			cfg.Sort, err = configString(key, value)
+		case "top":
+			cfg.Top, err = configInt(key, value)
+		case "threshold":
+			cfg.Threshold, err = configFloat(key, value)
+		case "bus_factor_threshold":
+			cfg.BusFactorThreshold, err = configFloat(key, value)
+		case "color_rules":
+			cfg.ColorRules, err = configColorRules(key, value)
+		case "themes":
+			cfg.Themes, err = configThemes(key, value)
+		case "theme":
+			cfg.Theme, err = configString(key, value)
+		case "extensions":
+			cfg.Extensions, err = configExtensions(key, value)
+		default:
+			err = fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+func configStrings(key string, value any) ([]string, error) {
+	values, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected an array of strings", key)
+	}
+	strs := make([]string, 0, len(values))
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: expected an array of strings", key)
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+func configString(key string, value any) (string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s: expected a string", key)
+	}
+	return s, nil
+}
+
+func configInt(key string, value any) (int, error) {
+	n, ok := value.(int64)
+	if !ok {
+		return 0, fmt.Errorf("%s: expected an integer", key)
+	}
+	return int(n), nil
+}
+
+func configFloat(key string, value any) (float64, error) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	default:
+		return 0, fmt.Errorf("%s: expected a number", key)
+	}
+}
+
+func configBool(key string, value any) (bool, error) {
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s: expected true or false", key)
+	}
+	return b, nil
+}
+
+// configColor accepts either a boolean or one of the --color modes.
+func configColor(key string, value any) (string, error) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return "always", nil
+		}
+		return "never", nil
+	case string:
+		return v, nil
+	default:
+		return "", fmt.Errorf("%s: expected true, false or a color mode", key)
+	}
+}
+
+// configColorRules reads an array of { above = N, color = "name" } tables.
+func configColorRules(key string, value any) ([]ColorRule, error) {
+	values, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected an array of tables", key)
+	}
+
+	rules := make([]ColorRule, 0, len(values))
+	for i, v := range values {
+		ruleKey := fmt.Sprintf("%s[%d]", key, i)
+		fields, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: expected a table", ruleKey)
+		}
+
+		var rule ColorRule
+		for field, v := range fields {
+			var err error
+			switch field {
+			case "above":
+				rule.Above, err = configFloat(ruleKey+"."+field, v)
+			case "color":
+				switch v := v.(type) {
+				case string:
+					rule.Color = v
+				case int64:
+					rule.Color = strconv.FormatInt(v, 10)
+				default:
+					err = fmt.Errorf("%s.%s: expected a color name or number", ruleKey, field)
+				}
+			default:
+				err = fmt.Errorf("%s: unknown key %q", ruleKey, field)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if rule.Color == "" {
+			return nil, fmt.Errorf("%s: missing color", ruleKey)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// configThemes reads a table of themes, each an array of color rules.
+func configThemes(key string, value any) (map[string][]ColorRule, error) {
+	table, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected a table", key)
+	}
+
+	themes := make(map[string][]ColorRule, len(table))
+	for name, v := range table {
+		rules, err := configColorRules(key+"."+name, v)
+		if err != nil {
+			return nil, err
+		}
+		themes[name] = rules
+	}
+	return themes, nil
+}
+
+func configExtensions(key string, value any) (map[string]ExtensionConfig, error) {
+	table, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected a table", key)
+	}
+
+	exts := make(map[string]ExtensionConfig, len(table))
+	for ext, settings := range table {
+		extKey := key + "." + ext
+		fields, ok := settings.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: expected a table", extKey)
+		}
+
+		var extCfg ExtensionConfig
+		for field, v := range fields {
+			var err error
+			switch field {
+			case "ignore":
+				extCfg.Ignore, err = configBool(extKey+"."+field, v)
+			default:
+				err = fmt.Errorf("%s: unknown key %q", extKey, field)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		exts[ext] = extCfg
+	}
+	return exts, nil
+}
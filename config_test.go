@@ -0,0 +1,147 @@
+package filetree
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigFormats(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		wantIgnore []string
+		wantErr    string
+	}{
+		{"toml", "ignore = [\"a\", \"b\"]\n", []string{"a", "b"}, ""},
+		{"flat list", "# old style\nvendor/\n*.log\n", []string{"vendor/", "*.log"}, ""},
+		{"flat list with class", "[Bb]uild\n", []string{"[Bb]uild"}, ""},
+		{"broken array", "show_files = true\nignore = [\"e\"\n", nil, "unterminated array"},
+		{"broken table", "[extensions\nignore = 1\n", nil, "line"},
+		{"broken array of tables", "[[rules]\nabove = 1\n", nil, "expected ]]"},
+		{"bad value", "max_depth = nope\n", nil, "line 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ConfigFile)
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadConfig() error = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(cfg.Ignore, tt.wantIgnore) {
+				t.Errorf("Ignore = %q, want %q", cfg.Ignore, tt.wantIgnore)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMissing(t *testing.T) {
+	cfg, err := LoadConfig(filepath.Join(t.TempDir(), ConfigFile))
+	if err != nil || cfg == nil || len(cfg.Ignore) > 0 {
+		t.Errorf("LoadConfig() = %+v, %v, want an empty config", cfg, err)
+	}
+}
+
+func TestLoadConfigValues(t *testing.T) {
+	showFiles := true
+	tests := []struct {
+		name    string
+		content string
+		want    *Config
+	}{
+		{"basics", `
+ignore = ["vendor/"]
+max_depth = 2
+show_files = true
+color = false
+
+[extensions.".min.js"]
+ignore = true
+`, &Config{
+			Ignore:     []string{"vendor/"},
+			MaxDepth:   2,
+			ShowFiles:  &showFiles,
+			Color:      "never",
+			Extensions: map[string]ExtensionConfig{".min.js": {Ignore: true}},
+		}},
+		{"defaults", "sort = \"email\"\ntop = 3\nthreshold = 5.5\nexclude = [\"*.pb.go\"]\n",
+			&Config{Sort: "email", Top: 3, Threshold: 5.5, Exclude: []string{"*.pb.go"}}},
+		{"generated", "generated = [\"*.gen.go\"]\n", &Config{Generated: []string{"*.gen.go"}}},
+		{"themes", "theme = \"mono\"\n[themes]\nmono = [{ above = 0, color = \"#808080\" }]\n",
+			&Config{Theme: "mono", Themes: map[string][]ColorRule{"mono": {{Above: 0, Color: "#808080"}}}}},
+		{"bus factor", "bus_factor_threshold = 80\n", &Config{BusFactorThreshold: 80}},
+		{"color rules", `color_rules = [{ above = 50, color = "red" }, { above = 0, color = 244 }]`,
+			&Config{ColorRules: []ColorRule{{Above: 50, Color: "red"}, {Above: 0, Color: "244"}}}},
+		{"color rules as tables", `
+[[color_rules]]
+above = 50
+color = "red"
+
+[[color_rules]]
+above = 0
+color = 244
+`, &Config{ColorRules: []ColorRule{{Above: 50, Color: "red"}, {Above: 0, Color: "244"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ConfigFile)
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cfg, tt.want) {
+				t.Errorf("LoadConfig() = %+v, want %+v", cfg, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigIgnorePatterns(t *testing.T) {
+	cfg := &Config{
+		Ignore:     []string{"vendor/"},
+		Extensions: map[string]ExtensionConfig{".min.js": {Ignore: true}, ".go": {}},
+	}
+	if patterns := cfg.IgnorePatterns(); !slices.Equal(patterns, []string{"vendor/", "*.min.js"}) {
+		t.Errorf("IgnorePatterns() = %q", patterns)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"colour = true\n", `unknown key "colour"`},
+		{"[[ignore]]\npattern = \"a\"\n", "ignore: expected an array of strings"},
+		{"show_files = 1\n", "show_files"},
+		{"top = \"three\"\n", "top"},
+		{"[extensions.\".js\"]\nskip = true\n", `unknown key "skip"`},
+		{"color_rules = [{ above = 50 }]\n", "missing color"},
+		{"themes = 1\n", "themes"},
+		{"[[color_rules]]\nabove = 50\ncolor = \"red\"\nshade = 1\n", `unknown key "shade"`},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), ConfigFile)
+		if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("LoadConfig(%q) error = %v, want one mentioning %q", tt.content, err, tt.want)
+		}
+	}
+}
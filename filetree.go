@@ -0,0 +1,1146 @@
+// Package filetree walks a directory tree and reports how much of each file
+// every author wrote, according to git blame.
+package filetree
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options controls how Walk traverses a directory tree.
+type Options struct {
+	// Patterns are gitignore-style patterns excluding paths from the walk
+	Patterns []string
+	// IncludeOnly, if non-empty, restricts the walk to files matching one of
+	// these patterns. Directories are still descended into, and Patterns
+	// take precedence: an ignored file is never included.
+	IncludeOnly []string
+	// IgnoreCase matches Patterns, IncludeOnly and nested ignore files
+	// regardless of case, as git does with core.ignorecase
+	IgnoreCase bool
+	// ShowHidden includes dotfiles and dot-directories, which are otherwise
+	// left out of the walk
+	ShowHidden bool
+	// ShowFiles includes file nodes in the tree. Otherwise each directory
+	// carries the aggregated stats of every file in its subtree.
+	ShowFiles bool
+	// FollowSymlinks descends into symlinked directories, skipping links
+	// that lead back to a directory already being walked. Otherwise a
+	// symlink is listed like a file and blamed as the link git tracks.
+	FollowSymlinks bool
+	// DirsFirst lists each directory's subdirectories before its files;
+	// otherwise entries are in plain name order
+	DirsFirst bool
+	// EntryOrder orders each directory's entries: OrderName (the default),
+	// OrderSize for the largest first or OrderAge for the least recently
+	// changed first. DirsFirst still applies.
+	EntryOrder string
+	// Depth limits how many levels below the root are walked; zero means
+	// unlimited. The files below the directories at the limit are only
+	// counted toward their Files, not blamed, so MinLines and MaxFiles
+	// don't apply to them.
+	Depth int
+	// Jobs is the number of git blame processes run concurrently; zero means
+	// one per CPU
+	Jobs int
+	// Retries is how many times a file is blamed again after git fails in a
+	// way that may pass, such as finding the index locked
+	Retries int
+	// BreadthFirst queues files for blame level by level, shallowest first,
+	// instead of in tree order. The tree itself is unaffected.
+	BreadthFirst bool
+	// SortBy orders each node's authors; nil means by line count
+	SortBy StatLess
+	// Top limits each node to its first Top authors plus an Others entry;
+	// zero shows every author
+	Top int
+	// Authors, if non-empty, limits the tree to files these canonical
+	// emails contributed to and shows only their stats. Directories without
+	// such files are pruned.
+	Authors []string
+	// ExcludeAuthors drops authors whose email matches one of these
+	// patterns, where * matches any run of characters and ? any single one,
+	// ignoring case. Their lines no longer count towards any total.
+	ExcludeAuthors []string
+	// HideUncommitted drops the lines attributed to UncommittedAuthor, so
+	// only committed lines count
+	HideUncommitted bool
+	// Threshold hides authors whose share of a node is below this percentage
+	Threshold float64
+	// ShowOthers sums the authors hidden by Threshold into an Others entry
+	ShowOthers bool
+	// MinLines leaves out files with fewer lines, and the directories left
+	// without any files. Without blame, lines are counted from the file
+	// itself.
+	MinLines int
+	// HideFiltered drops files whose authors all fall below Threshold rather
+	// than listing them without authors
+	HideFiltered bool
+	// BusFactorThreshold marks nodes whose top author wrote more than this
+	// percentage of them as SoleOwner; zero disables the check
+	BusFactorThreshold float64
+	// BusFactorOnly keeps only files marked SoleOwner and the directories
+	// leading to them. It only has an effect with ShowFiles.
+	BusFactorOnly bool
+	// GroupBy is GroupAuthor (the default) to report each author email or
+	// GroupDomain to merge authors by their email's domain
+	GroupBy string
+	// Prune leaves out directories with no files to show beneath them
+	Prune bool
+	// Collapse merges each directory whose only entry is a subdirectory
+	// into a single node named like "a/b/c"
+	Collapse bool
+	// Summary sets the root's Summary
+	Summary bool
+	// ByExtension sets the root's Extensions
+	ByExtension bool
+	// Blame controls how each file is blamed
+	Blame BlameOptions
+	// NoBlame skips git blame entirely and returns the bare tree, so no git
+	// process is run and dir need not be a git work tree
+	NoBlame bool
+	// CacheDir, if set, caches blame results in this directory and reuses
+	// them for files whose content hasn't changed since the same commit.
+	// Results for a repository's older commits are removed as it moves on.
+	CacheDir string
+	// MaxFiles aborts the walk with ErrTooManyFiles once more than this many
+	// files are queued for blame; zero means unlimited
+	MaxFiles int
+	// OnProgress, if set, is called as each file finishes blaming with the
+	// number of files done so far out of total. Calls are serialized.
+	OnProgress func(done, total int)
+	// OnFile, if set, is called as each file finishes blaming with its path
+	// and author stats, before the rest of the tree is done. It is called
+	// only for the files the tree would list with ShowFiles, after Authors,
+	// MinLines, HideFiltered and BusFactorOnly. Calls are serialized.
+	OnFile func(path string, authors []AuthorStat)
+	// StreamFiles drops each file's blame result once OnFile has seen it,
+	// so that results don't pile up in memory over a large walk. The
+	// returned tree then has no author stats.
+	StreamFiles bool
+	// OnBadPattern, if set, is called with a *PatternError for each
+	// malformed pattern in a nested ignore file. The pattern is left out.
+	OnBadPattern func(err error)
+	// OnBlameError, if set, is called for each file git blame fails on, such
+	// as untracked or binary files. Those files count as having no
+	// contributions and the walk carries on.
+	OnBlameError func(path string, err error)
+}
+
+const (
+	NodeDir  = "dir"
+	NodeFile = "file"
+)
+
+// Entry orders for Options.EntryOrder.
+const (
+	OrderName = "name"
+	OrderSize = "size"
+	OrderAge  = "age"
+)
+
+// Author groupings for Options.GroupBy.
+const (
+	GroupAuthor = "author"
+	GroupDomain = "domain"
+)
+
+// Node is a directory or file in the walked tree. Files carry their author
+// stats; directories carry their subtree's stats when files are not shown.
+type Node struct {
+	Name     string       `json:"name"`
+	Type     string       `json:"type"`
+	Authors  []AuthorStat `json:"authors,omitempty"`
+	Children []*Node      `json:"children,omitempty"`
+	// Total is a file's total contribution under the blame metric, its line
+	// count by default. Without ShowFiles, a directory's Total covers every
+	// file beneath it.
+	Total int `json:"total,omitempty"`
+	// Files is the number of files beneath a directory counted in its
+	// stats, set when ShowFiles isn't or the directory is at the depth
+	// limit
+	Files int `json:"files,omitempty"`
+	// Binary marks a file that was not blamed because it holds binary data
+	Binary bool `json:"binary,omitempty"`
+	// Size is a file's size in bytes, or the total size of the files in a
+	// directory's subtree
+	Size int64 `json:"size,omitempty"`
+	// Modified is when the most recent line in the node was authored,
+	// according to blame
+	Modified *time.Time `json:"modified,omitempty"`
+	// SoleOwner marks a node mostly written by one author, a knowledge silo,
+	// as set by Options.BusFactorThreshold
+	SoleOwner bool `json:"sole_owner,omitempty"`
+	// Summary is the overall ownership of the tree, set on the root when
+	// Options.Summary is set
+	Summary *Summary `json:"summary,omitempty"`
+	// Extensions is the ownership of the tree's files grouped by extension,
+	// set on the root when Options.ByExtension is set
+	Extensions []ExtensionSummary `json:"extensions,omitempty"`
+
+	path    string
+	contrib Contributions
+	// blob is a file's blob sha when walking another revision
+	blob string
+	// files counts the files walked in a directory's subtree
+	files int
+	// kept counts the files in a directory's subtree that passed MinLines
+	kept int
+	// truncated marks a directory at the depth limit, whose files were
+	// counted but not walked
+	truncated bool
+}
+
+// Summary is the overall ownership of a walked tree.
+type Summary struct {
+	// Files is the number of files walked, whether or not they were blamed
+	Files int `json:"files"`
+	// Total is the total contribution across every file, its line count by
+	// default
+	Total   int          `json:"total"`
+	Authors []AuthorStat `json:"authors,omitempty"`
+	// SoleOwned lists the files, relative to the root and slash-separated,
+	// mostly written by one author as set by Options.BusFactorThreshold,
+	// whether or not files are shown
+	SoleOwned []string `json:"sole_owned,omitempty"`
+}
+
+// summarize returns the overall ownership of the tree under root, whose files
+// were walked from dir. The authors are limited by opts the same way each
+// node's are.
+func summarize(root *Node, dir string, files []*Node, opts Options) Summary {
+	s := Summary{
+		Files:   root.files,
+		Total:   root.contrib.Total,
+		Authors: nodeStats(root.contrib, opts),
+	}
+	for _, file := range files {
+		if !hasMinLines(file, opts) || !hasAuthor(file.contrib, opts.Authors) || !soleOwner(file.contrib, opts.BusFactorThreshold) {
+			continue
+		}
+		rel, err := filepath.Rel(dir, file.path)
+		if err != nil {
+			rel = file.path
+		}
+		s.SoleOwned = append(s.SoleOwned, filepath.ToSlash(rel))
+	}
+	sort.Strings(s.SoleOwned)
+	return s
+}
+
+// ExtensionSummary is the ownership of every file with one extension.
+type ExtensionSummary struct {
+	// Extension includes the leading dot, and is empty for files without
+	// one
+	Extension string       `json:"extension"`
+	Files     int          `json:"files"`
+	Total     int          `json:"total"`
+	Authors   []AuthorStat `json:"authors,omitempty"`
+}
+
+// summarizeExtensions returns the ownership of the blamed files grouped by
+// extension, largest total first.
+func summarizeExtensions(files []*Node, opts Options) []ExtensionSummary {
+	type group struct {
+		files   int
+		contrib Contributions
+	}
+	groups := make(map[string]*group)
+	for _, file := range files {
+		if !hasMinLines(file, opts) {
+			continue
+		}
+		ext := filepath.Ext(file.path)
+		g, ok := groups[ext]
+		if !ok {
+			g = &group{}
+			groups[ext] = g
+		}
+		g.files++
+		g.contrib.Add(file.contrib)
+	}
+
+	summaries := make([]ExtensionSummary, 0, len(groups))
+	for ext, g := range groups {
+		summaries = append(summaries, ExtensionSummary{
+			Extension: ext,
+			Files:     g.files,
+			Total:     g.contrib.Total,
+			Authors:   nodeStats(g.contrib, opts),
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Total != summaries[j].Total {
+			return summaries[i].Total > summaries[j].Total
+		}
+		return summaries[i].Extension < summaries[j].Extension
+	})
+	return summaries
+}
+
+// ErrTooManyFiles is returned by Walk when the tree holds more files than
+// Options.MaxFiles.
+var ErrTooManyFiles = errors.New("too many files to blame")
+
+// Walk walks the directory tree rooted at dir and returns it as a Node. With
+// Blame.Ref set, the tree is the one git tracks at that revision.
+// Files are collected first and then blamed concurrently, so the returned
+// tree is in the same order regardless of which blame finishes first.
+// Cancelling ctx stops the walk and kills any running git processes.
+func Walk(ctx context.Context, dir string, opts Options) (*Node, error) {
+	w, err := newWalker(ctx, dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := w.walkTree()
+	if err != nil {
+		return nil, err
+	}
+	return w.finish(tree)
+}
+
+// BlamePaths blames exactly the files at paths, relative to the working
+// directory, instead of walking a directory. The returned root holds a file
+// node for each path, named by the path as given and in the same order unless
+// EntryOrder sorts them. Files are listed whatever ShowFiles says, and the
+// ignore patterns and directory options don't apply.
+func BlamePaths(ctx context.Context, paths []string, opts Options) (*Node, error) {
+	opts.ShowFiles = true
+	w, err := newWalker(ctx, ".", opts)
+	if err != nil {
+		return nil, err
+	}
+	root := &Node{Type: NodeDir}
+	for _, p := range paths {
+		absPath, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		fileInfo, err := os.Stat(absPath)
+		if err != nil {
+			return nil, err
+		}
+		if fileInfo.IsDir() {
+			return nil, fmt.Errorf("%s is a directory", p)
+		}
+
+		file := &Node{Name: p, Type: NodeFile, path: absPath, Size: fileInfo.Size()}
+		root.Children = append(root.Children, file)
+		if opts.NoBlame {
+			if opts.MinLines > 0 {
+				file.Total = countLines(absPath)
+			}
+			continue
+		}
+		if file.Binary = isBinary(absPath); !file.Binary {
+			w.files = append(w.files, file)
+		}
+	}
+	return w.finish(root)
+}
+
+// finish blames the files queued while building tree, unless blame is off,
+// and fills in the tree's stats.
+func (w *walker) finish(tree *Node) (*Node, error) {
+	opts := w.opts
+	if !opts.NoBlame {
+		jobs := opts.Jobs
+		if jobs <= 0 {
+			jobs = runtime.NumCPU()
+		}
+		var cache *blameCache
+		if opts.CacheDir != "" {
+			cache = &blameCache{dir: opts.CacheDir}
+		}
+		if err := w.blameFiles(jobs, cache); err != nil {
+			return nil, err
+		}
+	}
+
+	collectStats(tree, opts)
+	if opts.Collapse {
+		collapseChains(tree)
+	}
+	if opts.Summary {
+		s := summarize(tree, w.root, w.files, opts)
+		tree.Summary = &s
+	}
+	if opts.ByExtension {
+		tree.Extensions = summarizeExtensions(w.files, opts)
+	}
+	return tree, nil
+}
+
+// Files returns the paths of the files Walk would blame under dir, in the
+// order they would be queued, without running git blame. MinLines is not
+// applied, since it needs each file's blame.
+func Files(ctx context.Context, dir string, opts Options) ([]string, error) {
+	opts.NoBlame = false
+	w, err := newWalker(ctx, dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.walkTree(); err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(w.files))
+	for i, file := range w.files {
+		paths[i] = file.path
+	}
+	return paths, nil
+}
+
+// walker holds the state shared across a single walk.
+type walker struct {
+	ctx   context.Context
+	root  string
+	opts  Options
+	files []*Node
+	// ancestors holds the directory being walked and those above it, used
+	// to detect symlink cycles
+	ancestors []os.FileInfo
+}
+
+// newWalker returns a walker rooted at the absolute, cleaned form of dir, so
+// that the paths ignore patterns are matched against, relative to the root,
+// and the root's name don't depend on how dir was written.
+func newWalker(ctx context.Context, dir string, opts Options) (*walker, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if opts.IgnoreCase {
+		opts.Patterns = foldPatterns(opts.Patterns)
+		opts.IncludeOnly = foldPatterns(opts.IncludeOnly)
+	}
+	return &walker{ctx: ctx, root: root, opts: opts}, nil
+}
+
+// matchPath returns relPath as it is matched against ignore patterns,
+// lowercased like them when Options.IgnoreCase is set.
+func (w *walker) matchPath(relPath string) string {
+	if w.opts.IgnoreCase {
+		return strings.ToLower(relPath)
+	}
+	return relPath
+}
+
+// walkTree builds the tree rooted at w.root, from the working directory or
+// from Blame.Ref, and queues its files for blame in the configured order.
+func (w *walker) walkTree() (*Node, error) {
+	var tree *Node
+	var err error
+	if w.opts.Blame.Ref != "" {
+		tree, err = w.walkRef()
+	} else {
+		depth := w.opts.Depth
+		if depth <= 0 {
+			depth = -1
+		}
+		tree, err = w.walk(w.root, depth, []patternScope{{patterns: w.opts.Patterns}})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if w.opts.BreadthFirst {
+		w.queueBreadthFirst()
+	}
+	return tree, nil
+}
+
+// walk walks dir and returns it as a Node, queueing every file it finds for
+// blame. depth is the number of levels still to be walked below dir; a
+// negative depth means unlimited. scopes holds the ignore patterns inherited
+// from dir's ancestors.
+func (w *walker) walk(dir string, depth int, scopes []patternScope) (*Node, error) {
+	if err := w.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	dirNode := &Node{Name: fileInfo.Name(), Type: NodeDir, path: dir}
+	w.ancestors = append(w.ancestors, fileInfo)
+	defer func() { w.ancestors = w.ancestors[:len(w.ancestors)-1] }()
+
+	entries, scopes, err := w.readDir(dir, scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stop descending once the depth limit is reached, only counting the
+	// files below
+	if depth == 0 {
+		dirNode.truncated = true
+		if err := w.countFiles(dirNode, entries, scopes); err != nil {
+			return nil, err
+		}
+		return dirNode, nil
+	}
+
+	for _, entry := range entries {
+		if entry.isDir {
+			child, err := w.walk(entry.path, depth-1, scopes)
+			if err != nil {
+				return nil, err
+			}
+			dirNode.Children = append(dirNode.Children, child)
+			continue
+		}
+
+		file := &Node{Name: entry.Name(), Type: NodeFile, path: entry.path}
+		if info, err := entry.Info(); err == nil {
+			file.Size = info.Size()
+		}
+		dirNode.Children = append(dirNode.Children, file)
+		if w.opts.NoBlame {
+			if w.opts.MinLines > 0 {
+				file.Total = countLines(entry.path)
+			}
+			continue
+		}
+		if file.Binary = isBinary(entry.path); !file.Binary {
+			w.files = append(w.files, file)
+			if w.opts.MaxFiles > 0 && len(w.files) > w.opts.MaxFiles {
+				return nil, fmt.Errorf("%w: more than %d", ErrTooManyFiles, w.opts.MaxFiles)
+			}
+		}
+	}
+
+	return dirNode, nil
+}
+
+// countFiles adds the files among entries, the walked entries of a directory
+// at the depth limit, and everything beneath them to the counts and size of
+// n, without queueing them for blame.
+func (w *walker) countFiles(n *Node, entries []dirEntry, scopes []patternScope) error {
+	for _, entry := range entries {
+		if !entry.isDir {
+			n.files++
+			n.kept++
+			if info, err := entry.Info(); err == nil {
+				n.Size += info.Size()
+			}
+			continue
+		}
+		if err := w.ctx.Err(); err != nil {
+			return err
+		}
+		fileInfo, err := os.Stat(entry.path)
+		if err != nil {
+			return err
+		}
+		w.ancestors = append(w.ancestors, fileInfo)
+		children, childScopes, err := w.readDir(entry.path, scopes)
+		if err == nil {
+			err = w.countFiles(n, children, childScopes)
+		}
+		w.ancestors = w.ancestors[:len(w.ancestors)-1]
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirEntry is an entry of a walked directory.
+type dirEntry struct {
+	os.DirEntry
+	path string
+	// isDir is set for directories, including symlinks to them when
+	// following symlinks
+	isDir bool
+}
+
+// readDir returns the entries of dir that the walk covers, in walk order,
+// leaving out hidden and ignored entries, files not matching IncludeOnly and
+// symlinks that loop back to a directory being walked. It also returns the
+// scopes that apply beneath dir, which add dir's own ignore files to those
+// inherited from its ancestors.
+func (w *walker) readDir(dir string, scopes []patternScope) ([]dirEntry, []patternScope, error) {
+	// A nested .gitignore or .filetreeignore applies to this directory's
+	// subtree only; the root's own patterns are already part of
+	// Options.Patterns
+	if dir != w.root {
+		patterns, err := loadGitignore(filepath.Join(dir, ".gitignore"), w.opts.OnBadPattern)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error loading .gitignore: %v", err)
+		}
+		filetreePatterns, err := loadGitignore(filepath.Join(dir, IgnoreFile), w.opts.OnBadPattern)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error loading %s: %v", IgnoreFile, err)
+		}
+		patterns = append(patterns, filetreePatterns...)
+		if w.opts.IgnoreCase {
+			patterns = foldPatterns(patterns)
+		}
+		if len(patterns) > 0 {
+			relDir, err := filepath.Rel(w.root, dir)
+			if err != nil {
+				return nil, nil, err
+			}
+			scopes = append(scopes[:len(scopes):len(scopes)], patternScope{base: filepath.ToSlash(relDir), patterns: patterns})
+		}
+	}
+
+	// Read directory contents
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if w.opts.DirsFirst {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].IsDir() && !entries[j].IsDir()
+		})
+	}
+
+	walked := make([]dirEntry, 0, len(entries))
+	for _, entry := range entries {
+		if !w.opts.ShowHidden && strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		newPath := filepath.Join(dir, entry.Name())
+
+		relPath, err := filepath.Rel(w.root, newPath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		isDir := entry.IsDir()
+		if entry.Type()&os.ModeSymlink != 0 && w.opts.FollowSymlinks {
+			target, err := os.Stat(newPath)
+			if err == nil && target.IsDir() {
+				if w.isAncestor(target) {
+					continue
+				}
+				isDir = true
+			}
+		}
+		if matchesScopes(w.matchPath(relPath), isDir, scopes) {
+			continue
+		}
+		if !isDir && len(w.opts.IncludeOnly) > 0 && !MatchesGitignore(w.matchPath(relPath), w.opts.IncludeOnly) {
+			continue
+		}
+		walked = append(walked, dirEntry{DirEntry: entry, path: newPath, isDir: isDir})
+	}
+	return walked, scopes, nil
+}
+
+// isAncestor reports whether dir is one of the directories being walked,
+// meaning a symlink to it would loop forever.
+func (w *walker) isAncestor(dir os.FileInfo) bool {
+	for _, ancestor := range w.ancestors {
+		if os.SameFile(ancestor, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// binarySniffLen is how much of a file is checked for NUL bytes, matching
+// git's own binary detection.
+const binarySniffLen = 8000
+
+// isBinary reports whether the file at path looks like binary data. Files
+// that can't be read are left for git blame to report.
+func isBinary(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	return hasNUL(file)
+}
+
+// hasNUL reports whether the first binarySniffLen bytes of r hold a NUL.
+func hasNUL(r io.Reader) bool {
+	buf := make([]byte, binarySniffLen)
+	n, _ := io.ReadFull(r, buf)
+	return bytes.IndexByte(buf[:n], 0) >= 0
+}
+
+// queueBreadthFirst reorders the queued files by depth, keeping tree order
+// within each level.
+func (w *walker) queueBreadthFirst() {
+	sep := string(filepath.Separator)
+	sort.SliceStable(w.files, func(i, j int) bool {
+		return strings.Count(w.files[i].path, sep) < strings.Count(w.files[j].path, sep)
+	})
+}
+
+// blameFiles runs FileContributions for every queued file across a pool of
+// jobs workers, going through cache if it is non-nil. A limiter lowers the
+// number of concurrent git processes while the system is short of them.
+// Each worker only writes to the files it is handed, so no locking is
+// needed. Failures are reported to OnBlameError in queue order; only
+// cancellation of the walk's context fails the whole run.
+func (w *walker) blameFiles(jobs int, cache *blameCache) error {
+	ctx, files := w.ctx, w.files
+	errs := make([]error, len(files))
+	indexes := make(chan int)
+
+	var progressMu sync.Mutex
+	done := 0
+	finished := func(file *Node) {
+		if w.opts.OnFile == nil && w.opts.OnProgress == nil {
+			return
+		}
+		progressMu.Lock()
+		defer progressMu.Unlock()
+		if w.opts.OnFile != nil {
+			if authors, ok := listedStats(file, w.opts); ok {
+				w.opts.OnFile(file.path, authors)
+			}
+		}
+		if w.opts.StreamFiles {
+			file.contrib = Contributions{}
+		}
+		done++
+		if w.opts.OnProgress != nil {
+			w.opts.OnProgress(done, len(files))
+		}
+	}
+
+	lim := newLimiter(jobs)
+	var wg sync.WaitGroup
+	for range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				files[i].contrib, errs[i] = w.blameFile(files[i], cache, lim)
+				w.attribute(files[i])
+				finished(files[i])
+			}
+		}()
+	}
+feed:
+	for i := range files {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if w.opts.OnBlameError == nil {
+		return nil
+	}
+	for i, err := range errs {
+		if err != nil {
+			w.opts.OnBlameError(files[i].path, err)
+		}
+	}
+	return nil
+}
+
+// collectStats turns the blame results under n into author stats and returns
+// the contributions for n's whole subtree. File nodes are kept only when
+// ShowFiles is set and they have attributed lines, or blame is disabled;
+// otherwise directories carry the stats of everything beneath them.
+func collectStats(n *Node, opts Options) Contributions {
+	var dirContrib Contributions
+
+	children := n.Children[:0]
+	for _, child := range n.Children {
+		if child.Type == NodeDir {
+			childContrib := collectStats(child, opts)
+			dirContrib.Add(childContrib)
+			n.files += child.files
+			n.kept += child.kept
+			n.Size += child.Size
+			if (opts.MinLines > 0 || opts.Prune) && child.kept == 0 {
+				continue
+			}
+			if opts.Prune && opts.ShowFiles && len(child.Children) == 0 && !child.truncated {
+				continue
+			}
+			if hasAuthor(childContrib, opts.Authors) && (!opts.BusFactorOnly || len(child.Children) > 0) {
+				children = append(children, child)
+			}
+			continue
+		}
+
+		n.files++
+		n.Size += child.Size
+		if !hasMinLines(child, opts) {
+			continue
+		}
+		dirContrib.Add(child.contrib)
+		n.kept++
+		if !hasAuthor(child.contrib, opts.Authors) {
+			continue
+		}
+		if opts.ShowFiles && (child.Binary || opts.NoBlame) {
+			if !opts.BusFactorOnly {
+				children = append(children, child)
+			}
+		} else if opts.ShowFiles && child.contrib.Total > 0 {
+			child.Total = child.contrib.Total
+			child.Authors = nodeStats(child.contrib, opts)
+			child.SoleOwner = soleOwner(child.contrib, opts.BusFactorThreshold)
+			child.Modified = latest(child.contrib)
+			if (len(child.Authors) > 0 || !opts.HideFiltered) && (child.SoleOwner || !opts.BusFactorOnly) {
+				children = append(children, child)
+			}
+		}
+	}
+	n.Children = children
+	switch opts.EntryOrder {
+	case OrderSize:
+		sortEntries(n.Children, opts.DirsFirst, func(a, b *Node) bool { return a.Size > b.Size })
+	case OrderAge:
+		sortEntries(n.Children, opts.DirsFirst, func(a, b *Node) bool { return modified(a).Before(modified(b)) })
+	}
+
+	// A directory at the depth limit lists no files, so its file count
+	// stands in for them
+	if !opts.ShowFiles || n.truncated {
+		n.Files = n.kept
+	}
+	if !opts.ShowFiles {
+		n.Total = dirContrib.Total
+	}
+	if !opts.ShowFiles && dirContrib.Total > 0 {
+		n.Authors = nodeStats(dirContrib, opts)
+		n.SoleOwner = soleOwner(dirContrib, opts.BusFactorThreshold)
+	}
+	n.Modified = latest(dirContrib)
+	n.contrib = dirContrib
+	return dirContrib
+}
+
+// listedStats returns the author stats of a blamed file as collectStats
+// lists it when ShowFiles is set, and false if the file isn't listed.
+func listedStats(file *Node, opts Options) ([]AuthorStat, bool) {
+	if !hasMinLines(file, opts) || !hasAuthor(file.contrib, opts.Authors) || file.contrib.Total == 0 {
+		return nil, false
+	}
+	authors := nodeStats(file.contrib, opts)
+	if len(authors) == 0 && opts.HideFiltered {
+		return nil, false
+	}
+	if opts.BusFactorOnly && !soleOwner(file.contrib, opts.BusFactorThreshold) {
+		return nil, false
+	}
+	return authors, true
+}
+
+// collapseChains merges every directory below n that holds nothing but a
+// single subdirectory with that subdirectory. The merged node keeps the
+// innermost directory's stats, which cover the same files.
+func collapseChains(n *Node) {
+	for i, child := range n.Children {
+		for child.Type == NodeDir && len(child.Children) == 1 {
+			only := child.Children[0]
+			// A directory's own files may be hidden when files aren't
+			// shown, so compare file counts to be sure it has none
+			if only.Type != NodeDir || only.files != child.files {
+				break
+			}
+			only.Name = child.Name + "/" + only.Name
+			child = only
+		}
+		n.Children[i] = child
+		collapseChains(child)
+	}
+}
+
+// hasMinLines reports whether file has at least MinLines lines, counting
+// them from its blame or, without blame, from its content.
+func hasMinLines(file *Node, opts Options) bool {
+	if opts.MinLines <= 0 {
+		return true
+	}
+	lines := file.contrib.Total
+	if opts.NoBlame {
+		lines = file.Total
+	}
+	return lines >= opts.MinLines
+}
+
+// countLines returns the number of lines in the file at path, counting a
+// final line without a newline.
+func countLines(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	return lineCount(data)
+}
+
+// lineCount returns the number of lines in data, counting a final line
+// without a newline.
+func lineCount(data []byte) int {
+	if len(data) == 0 {
+		return 0
+	}
+	lines := bytes.Count(data, []byte{'\n'})
+	if data[len(data)-1] != '\n' {
+		lines++
+	}
+	return lines
+}
+
+// latest returns c.Latest, or nil if no line has an author time.
+func latest(c Contributions) *time.Time {
+	if c.Latest.IsZero() {
+		return nil
+	}
+	t := c.Latest
+	return &t
+}
+
+// modified returns when n last changed, or the zero time if unknown.
+func modified(n *Node) time.Time {
+	if n.Modified == nil {
+		return time.Time{}
+	}
+	return *n.Modified
+}
+
+// sortEntries stably sorts children by less, keeping directories ahead of
+// files if dirsFirst is set.
+func sortEntries(children []*Node, dirsFirst bool, less func(a, b *Node) bool) {
+	sort.SliceStable(children, func(i, j int) bool {
+		a, b := children[i], children[j]
+		if dirsFirst && (a.Type == NodeDir) != (b.Type == NodeDir) {
+			return a.Type == NodeDir
+		}
+		return less(a, b)
+	})
+}
+
+// soleOwner reports whether a single author's share of c is above threshold
+// percent. A zero threshold never matches.
+func soleOwner(c Contributions, threshold float64) bool {
+	if threshold <= 0 || c.Total == 0 {
+		return false
+	}
+	top := 0
+	for _, count := range c.Counts {
+		top = max(top, count)
+	}
+	return float64(top)*100/float64(c.Total) > threshold
+}
+
+// maxResourceRetries is how many times a file is blamed again after git
+// fails for lack of processes or file descriptors.
+const maxResourceRetries = 5
+
+// retryDelay is the wait before a file's first retry, doubling with each
+// one after.
+const retryDelay = 50 * time.Millisecond
+
+// blameFile blames file once lim allows another git process, retrying with
+// a growing delay while git fails for lack of system resources, and up to
+// Options.Retries times after a transient failure.
+func (w *walker) blameFile(file *Node, cache *blameCache, lim *limiter) (Contributions, error) {
+	retries := 0
+	for attempt := 0; ; attempt++ {
+		lim.acquire()
+		var contrib Contributions
+		var err error
+		if cache != nil {
+			contrib, err = cache.cachedContributions(w.ctx, file.path, file.blob, w.opts.Blame)
+		} else {
+			contrib, err = FileContributions(w.ctx, file.path, w.opts.Blame)
+		}
+		lim.release(err)
+		switch {
+		case isResourceError(err) && attempt < maxResourceRetries:
+		case isTransientError(err) && retries < w.opts.Retries:
+			retries++
+		default:
+			return contrib, err
+		}
+
+		select {
+		case <-w.ctx.Done():
+			return Contributions{}, w.ctx.Err()
+		case <-time.After(retryDelay << attempt):
+		}
+	}
+}
+
+// attribute applies the author exclusions and grouping to a blamed file's
+// contributions.
+func (w *walker) attribute(file *Node) {
+	if len(w.opts.ExcludeAuthors) > 0 {
+		file.contrib = withoutAuthors(file.contrib, w.opts.ExcludeAuthors)
+	}
+	if w.opts.HideUncommitted {
+		file.contrib = withoutAuthors(file.contrib, []string{UncommittedAuthor})
+	}
+	if w.opts.GroupBy == GroupDomain {
+		file.contrib = byDomain(file.contrib)
+	}
+}
+
+// withoutAuthors returns c with the authors matching any of patterns removed,
+// and Latest taken from the lines of the authors kept.
+func withoutAuthors(c Contributions, patterns []string) Contributions {
+	kept := Contributions{Counts: make(map[string]int, len(c.Counts)), Names: c.Names, LatestBy: c.LatestBy}
+	for email, count := range c.Counts {
+		if !matchesAnyWildcard(email, patterns) {
+			kept.Counts[email] = count
+			kept.Total += count
+			if c.Commits != nil {
+				if kept.Commits == nil {
+					kept.Commits = make(map[string]map[string]bool, len(c.Commits))
+				}
+				kept.Commits[email] = c.Commits[email]
+			}
+			if latest := c.LatestBy[email]; latest.After(kept.Latest) {
+				kept.Latest = latest
+			}
+		}
+	}
+	return kept
+}
+
+// matchesAnyWildcard reports whether s matches one of patterns, ignoring
+// case.
+func matchesAnyWildcard(s string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matchWildcard(strings.ToLower(pattern), strings.ToLower(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchWildcard reports whether s matches pattern, in which * matches any
+// run of characters and ? any single character. Unlike path.Match, brackets
+// are literal, so "*[bot]*" matches bot accounts.
+func matchWildcard(pattern, s string) bool {
+	// On a mismatch, backtrack to the last * and let it absorb one more
+	// character
+	p, i := 0, 0
+	star, starMatch := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, starMatch = p, i
+			p++
+		case star >= 0:
+			starMatch++
+			p, i = star+1, starMatch
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// unknownDomain is the group for author emails without a domain.
+const unknownDomain = "(unknown)"
+
+// byDomain merges the authors in c by the domain of their email, keyed as
+// "@domain".
+func byDomain(c Contributions) Contributions {
+	grouped := Contributions{
+		Counts:   make(map[string]int, len(c.Counts)),
+		Total:    c.Total,
+		Latest:   c.Latest,
+		LatestBy: make(map[string]time.Time, len(c.LatestBy)),
+	}
+	for email, count := range c.Counts {
+		group := email
+		if email != UncommittedAuthor {
+			group = unknownDomain
+			if i := strings.LastIndex(email, "@"); i >= 0 && i < len(email)-1 {
+				group = strings.ToLower(email[i:])
+			}
+		}
+		grouped.Counts[group] += count
+		if commits := c.Commits[email]; commits != nil {
+			if grouped.Commits == nil {
+				grouped.Commits = make(map[string]map[string]bool, len(c.Commits))
+			}
+			if grouped.Commits[group] == nil {
+				grouped.Commits[group] = make(map[string]bool, len(commits))
+			}
+			for commit := range commits {
+				grouped.Commits[group][commit] = true
+			}
+		}
+		if latest := c.LatestBy[email]; latest.After(grouped.LatestBy[group]) {
+			grouped.LatestBy[group] = latest
+		}
+	}
+	return grouped
+}
+
+// nodeStats computes the author stats displayed for a node.
+func nodeStats(c Contributions, opts Options) []AuthorStat {
+	stats := CalculateAndSortStats(c.Counts, c.Total, opts.SortBy)
+	for i := range stats {
+		stats[i].Name = c.Names[stats[i].Email]
+	}
+
+	if len(opts.Authors) > 0 {
+		selected := stats[:0]
+		for _, stat := range stats {
+			if matchesAuthor(stat.Email, opts.Authors) {
+				selected = append(selected, stat)
+			}
+		}
+		stats = selected
+	}
+	return limitStats(stats, opts)
+}
+
+// hasAuthor reports whether any of authors contributed to c. An empty
+// authors list matches everything.
+func hasAuthor(c Contributions, authors []string) bool {
+	if len(authors) == 0 {
+		return true
+	}
+	for email := range c.Counts {
+		if matchesAuthor(email, authors) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAuthor reports whether email is one of authors, ignoring case.
+func matchesAuthor(email string, authors []string) bool {
+	for _, author := range authors {
+		if strings.EqualFold(email, author) {
+			return true
+		}
+	}
+	return false
+}
+
+// limitStats applies the Threshold and Top options to sorted stats.
+func limitStats(stats []AuthorStat, opts Options) []AuthorStat {
+	stats = FilterAuthors(stats, opts.Threshold, opts.ShowOthers)
+	return TopAuthors(stats, opts.Top)
+}
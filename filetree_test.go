@@ -0,0 +1,707 @@
+package filetree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestOnFileFilters(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.commit("alice@x.org", map[string]string{"alice.go": "a\nb\nc\n", "shared.go": "a\n"})
+	repo.commit("bob@x.org", map[string]string{"shared.go": "a\nb\n", "tiny.go": "z\n"})
+
+	tests := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{"all", Options{}, []string{"alice.go", "shared.go", "tiny.go"}},
+		{"author", Options{Authors: []string{"bob@x.org"}}, []string{"shared.go", "tiny.go"}},
+		{"min lines", Options{MinLines: 2}, []string{"alice.go", "shared.go"}},
+		{"bus factor only", Options{BusFactorOnly: true, BusFactorThreshold: 90}, []string{"alice.go", "tiny.go"}},
+		{"hide filtered", Options{Threshold: 60, HideFiltered: true}, []string{"alice.go", "tiny.go"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			opts := tt.opts
+			opts.OnFile = func(path string, authors []AuthorStat) {
+				rel, _ := filepath.Rel(repo.dir, path)
+				got = append(got, rel)
+			}
+			opts.StreamFiles = true
+			if _, err := Walk(context.Background(), repo.dir, opts); err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("OnFile saw %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestModifiedAfterRegrouping(t *testing.T) {
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	repo := newTestRepo(t)
+	repo.commitAt("alice@a.org", old, map[string]string{"f.go": "a\n"})
+	repo.commitAt("bot@b.org", recent, map[string]string{"f.go": "a\nb\n"})
+
+	tests := []struct {
+		name string
+		opts Options
+		want time.Time
+	}{
+		{"all authors", Options{}, recent},
+		{"by domain", Options{GroupBy: GroupDomain}, recent},
+		{"excluded author", Options{ExcludeAuthors: []string{"bot@*"}}, old},
+		{"excluded author by domain", Options{ExcludeAuthors: []string{"bot@*"}, GroupBy: GroupDomain}, old},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.ShowFiles = true
+			tree, err := Walk(context.Background(), repo.dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file := childByName(t, tree, "f.go")
+			if file.Modified == nil || !file.Modified.Equal(tt.want) {
+				t.Errorf("Modified = %v, want %v", file.Modified, tt.want)
+			}
+		})
+	}
+}
+
+// statsRepo returns a repository whose files alice, bob and a bot wrote
+// parts of, with an uncommitted line and a binary file:
+//
+//	README.md              alice 1, uncommitted 1
+//	docs/guide.md          bob 3
+//	logo.png               binary
+//	src/deep/nested/gen.go bot 1
+//	src/main.go            alice 6
+//	src/util.go            alice 2, bob 2
+func statsRepo(t *testing.T) *testRepo {
+	t.Helper()
+	repo := newTestRepo(t)
+	repo.commit("alice@a.org", map[string]string{
+		"README.md":   "r1\n",
+		"logo.png":    "\x89PNG\r\n\x1a\n\x00\x00",
+		"src/main.go": "1\n2\n3\n4\n5\n6\n",
+		"src/util.go": "u1\nu2\n",
+	})
+	repo.commit("bob@b.org", map[string]string{
+		"docs/guide.md": "g1\ng2\ng3\n",
+		"src/util.go":   "u1\nu2\nu3\nu4\n",
+	})
+	repo.commit("bot[bot]@c.org", map[string]string{"src/deep/nested/gen.go": "x\n"})
+	repo.write("README.md", "r1\nr2\n")
+	return repo
+}
+
+// describe renders the tree under n one node per line, indented by depth,
+// with each directory's file count, each node's total and its authors.
+func describe(n *Node) string {
+	var b strings.Builder
+	var visit func(n *Node, indent string)
+	visit = func(n *Node, indent string) {
+		b.WriteString(indent + n.Name)
+		if n.Type == NodeDir {
+			fmt.Fprintf(&b, "/ [%d]", n.Files)
+		}
+		if n.Binary {
+			b.WriteString(" binary")
+		}
+		if n.SoleOwner {
+			b.WriteString(" sole")
+		}
+		fmt.Fprintf(&b, " (%d)", n.Total)
+		for i, stat := range n.Authors {
+			sep := ", "
+			if i == 0 {
+				sep = ": "
+			}
+			email := stat.Email
+			if stat.Others {
+				email = "others"
+			}
+			fmt.Fprintf(&b, "%s%s %d", sep, email, stat.Count)
+		}
+		b.WriteString("\n")
+		for _, child := range n.Children {
+			visit(child, indent+"  ")
+		}
+	}
+	n.Name = "."
+	visit(n, "")
+	return b.String()
+}
+
+func TestWalkStats(t *testing.T) {
+	repo := statsRepo(t)
+	tests := []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{"dirs", Options{}, `./ [6] (16): alice@a.org 9, bob@b.org 5, (uncommitted) 1, bot[bot]@c.org 1
+  docs/ [1] (3): bob@b.org 3
+  src/ [3] (11): alice@a.org 8, bob@b.org 2, bot[bot]@c.org 1
+    deep/ [1] (1): bot[bot]@c.org 1
+      nested/ [1] (1): bot[bot]@c.org 1
+`},
+		{"top", Options{Top: 1}, `./ [6] (16): alice@a.org 9, others 7
+  docs/ [1] (3): bob@b.org 3
+  src/ [3] (11): alice@a.org 8, others 3
+    deep/ [1] (1): bot[bot]@c.org 1
+      nested/ [1] (1): bot[bot]@c.org 1
+`},
+		{"threshold with others", Options{Threshold: 10, ShowOthers: true}, `./ [6] (16): alice@a.org 9, bob@b.org 5, others 2
+  docs/ [1] (3): bob@b.org 3
+  src/ [3] (11): alice@a.org 8, bob@b.org 2, others 1
+    deep/ [1] (1): bot[bot]@c.org 1
+      nested/ [1] (1): bot[bot]@c.org 1
+`},
+		// Each author's commit touched several files, but counts once in
+		// every directory above them
+		{"commits", Options{Blame: BlameOptions{Metric: MetricCommits}}, `./ [6] (4): (uncommitted) 1, alice@a.org 1, bob@b.org 1, bot[bot]@c.org 1
+  docs/ [1] (1): bob@b.org 1
+  src/ [3] (3): alice@a.org 1, bob@b.org 1, bot[bot]@c.org 1
+    deep/ [1] (1): bot[bot]@c.org 1
+      nested/ [1] (1): bot[bot]@c.org 1
+`},
+		{"depth", Options{Depth: 2}, `./ [6] (15): alice@a.org 9, bob@b.org 5, (uncommitted) 1
+  docs/ [1] (3): bob@b.org 3
+  src/ [3] (10): alice@a.org 8, bob@b.org 2
+    deep/ [1] (0)
+`},
+		{"author", Options{ShowFiles: true, Authors: []string{"bob@b.org"}}, `./ [0] (0)
+  docs/ [0] (0)
+    guide.md (3): bob@b.org 3
+  src/ [0] (0)
+    util.go (4): bob@b.org 2
+`},
+		{"files", Options{ShowFiles: true, DirsFirst: true}, `./ [0] (0)
+  docs/ [0] (0)
+    guide.md (3): bob@b.org 3
+  src/ [0] (0)
+    deep/ [0] (0)
+      nested/ [0] (0)
+        gen.go (1): bot[bot]@c.org 1
+    main.go (6): alice@a.org 6
+    util.go (4): alice@a.org 2, bob@b.org 2
+  README.md (2): (uncommitted) 1, alice@a.org 1
+  logo.png binary (0)
+`},
+		{"name order", Options{ShowFiles: true}, `./ [0] (0)
+  README.md (2): (uncommitted) 1, alice@a.org 1
+  docs/ [0] (0)
+    guide.md (3): bob@b.org 3
+  logo.png binary (0)
+  src/ [0] (0)
+    deep/ [0] (0)
+      nested/ [0] (0)
+        gen.go (1): bot[bot]@c.org 1
+    main.go (6): alice@a.org 6
+    util.go (4): alice@a.org 2, bob@b.org 2
+`},
+		{"bus factor", Options{ShowFiles: true, BusFactorThreshold: 90}, `./ [0] (0)
+  README.md (2): (uncommitted) 1, alice@a.org 1
+  docs/ [0] (0)
+    guide.md sole (3): bob@b.org 3
+  logo.png binary (0)
+  src/ [0] (0)
+    deep/ [0] (0)
+      nested/ [0] (0)
+        gen.go sole (1): bot[bot]@c.org 1
+    main.go sole (6): alice@a.org 6
+    util.go (4): alice@a.org 2, bob@b.org 2
+`},
+		{"bus factor only", Options{ShowFiles: true, BusFactorThreshold: 90, BusFactorOnly: true}, `./ [0] (0)
+  docs/ [0] (0)
+    guide.md sole (3): bob@b.org 3
+  src/ [0] (0)
+    deep/ [0] (0)
+      nested/ [0] (0)
+        gen.go sole (1): bot[bot]@c.org 1
+    main.go sole (6): alice@a.org 6
+`},
+		{"by domain", Options{GroupBy: GroupDomain, SortBy: ByEmail}, `./ [6] (16): (uncommitted) 1, @a.org 9, @b.org 5, @c.org 1
+  docs/ [1] (3): @b.org 3
+  src/ [3] (11): @a.org 8, @b.org 2, @c.org 1
+    deep/ [1] (1): @c.org 1
+      nested/ [1] (1): @c.org 1
+`},
+		{"size order", Options{ShowFiles: true, EntryOrder: OrderSize}, `./ [0] (0)
+  src/ [0] (0)
+    main.go (6): alice@a.org 6
+    util.go (4): alice@a.org 2, bob@b.org 2
+    deep/ [0] (0)
+      nested/ [0] (0)
+        gen.go (1): bot[bot]@c.org 1
+  logo.png binary (0)
+  docs/ [0] (0)
+    guide.md (3): bob@b.org 3
+  README.md (2): (uncommitted) 1, alice@a.org 1
+`},
+		{"min lines", Options{ShowFiles: true, MinLines: 3}, `./ [0] (0)
+  docs/ [0] (0)
+    guide.md (3): bob@b.org 3
+  src/ [0] (0)
+    main.go (6): alice@a.org 6
+    util.go (4): alice@a.org 2, bob@b.org 2
+`},
+		{"collapse", Options{Collapse: true}, `./ [6] (16): alice@a.org 9, bob@b.org 5, (uncommitted) 1, bot[bot]@c.org 1
+  docs/ [1] (3): bob@b.org 3
+  src/ [3] (11): alice@a.org 8, bob@b.org 2, bot[bot]@c.org 1
+    deep/nested/ [1] (1): bot[bot]@c.org 1
+`},
+		{"prune", Options{ShowFiles: true, IncludeOnly: []string{"*.md"}, Prune: true}, `./ [0] (0)
+  README.md (2): (uncommitted) 1, alice@a.org 1
+  docs/ [0] (0)
+    guide.md (3): bob@b.org 3
+`},
+		{"exclude author", Options{ExcludeAuthors: []string{"*[bot]*"}}, `./ [6] (15): alice@a.org 9, bob@b.org 5, (uncommitted) 1
+  docs/ [1] (3): bob@b.org 3
+  src/ [3] (10): alice@a.org 8, bob@b.org 2
+    deep/ [1] (0)
+      nested/ [1] (0)
+`},
+		{"hide uncommitted", Options{HideUncommitted: true}, `./ [6] (15): alice@a.org 9, bob@b.org 5, bot[bot]@c.org 1
+  docs/ [1] (3): bob@b.org 3
+  src/ [3] (11): alice@a.org 8, bob@b.org 2, bot[bot]@c.org 1
+    deep/ [1] (1): bot[bot]@c.org 1
+      nested/ [1] (1): bot[bot]@c.org 1
+`},
+		{"include only", Options{ShowFiles: true, IncludeOnly: []string{"*.md"}}, `./ [0] (0)
+  README.md (2): (uncommitted) 1, alice@a.org 1
+  docs/ [0] (0)
+    guide.md (3): bob@b.org 3
+  src/ [0] (0)
+    deep/ [0] (0)
+      nested/ [0] (0)
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree, err := Walk(context.Background(), repo.dir, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := describe(tree); got != tt.want {
+				t.Errorf("tree:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWalkSummary(t *testing.T) {
+	repo := statsRepo(t)
+	for _, showFiles := range []bool{false, true} {
+		opts := Options{ShowFiles: showFiles, Summary: true, ByExtension: true, BusFactorThreshold: 90, Top: 2}
+		tree, err := Walk(context.Background(), repo.dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := tree.Summary
+		if s == nil {
+			t.Fatal("no summary")
+		}
+		if s.Files != 6 || s.Total != 16 {
+			t.Errorf("files %v: summary has %d files, %d lines; want 6, 16", showFiles, s.Files, s.Total)
+		}
+		want := []AuthorStat{
+			{Name: "alice", Email: "alice@a.org", Count: 9, Percentage: 56.25},
+			{Name: "bob", Email: "bob@b.org", Count: 5, Percentage: 31.25},
+			{Count: 2, Percentage: 12.5, Others: true},
+		}
+		if !slices.Equal(s.Authors, want) {
+			t.Errorf("files %v: summary authors %+v, want %+v", showFiles, s.Authors, want)
+		}
+		if sole := []string{"docs/guide.md", "src/deep/nested/gen.go", "src/main.go"}; !slices.Equal(s.SoleOwned, sole) {
+			t.Errorf("files %v: sole owned %q, want %q", showFiles, s.SoleOwned, sole)
+		}
+
+		var exts []string
+		for _, ext := range tree.Extensions {
+			exts = append(exts, fmt.Sprintf("%s %d %d", ext.Extension, ext.Files, ext.Total))
+		}
+		if want := []string{".go 3 11", ".md 2 5"}; !slices.Equal(exts, want) {
+			t.Errorf("files %v: extensions %q, want %q", showFiles, exts, want)
+		}
+	}
+}
+
+func TestDepthCountsDeeperFiles(t *testing.T) {
+	repo := newTestRepo(t)
+	blames := countBlames(t)
+	repo.commit("alice@x.org", map[string]string{"top.go": "a\n", "a/mid.go": "a\n", "a/b/deep.go": "a\nb\n", "a/b/skip.log": "x\n"})
+	repo.commit("bob@x.org", map[string]string{"e/f/g.go": "a\nb\nc\n"})
+
+	for _, ref := range []string{"", "HEAD"} {
+		for _, showFiles := range []bool{false, true} {
+			for _, noBlame := range []bool{false, true} {
+				// Only top.go is walked, so it alone counts toward
+				// MaxFiles
+				opts := Options{Depth: 1, ShowFiles: showFiles, NoBlame: noBlame, MaxFiles: 1, Patterns: []string{"*.log"}}
+				opts.Blame.Ref = ref
+				before := blames()
+				tree, err := Walk(context.Background(), repo.dir, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				name := fmt.Sprintf("ref %q, files %v, no blame %v", ref, showFiles, noBlame)
+				want := 1
+				if noBlame {
+					want = 0
+				}
+				if got := blames() - before; got != want {
+					t.Errorf("%s: %d blame calls, want %d", name, got, want)
+				}
+				for _, dir := range []struct {
+					name  string
+					files int
+				}{
+					{"a", 2},
+					{"e", 1},
+				} {
+					node := childByName(t, tree, dir.name)
+					if len(node.Children) > 0 || node.Files != dir.files || node.Total != 0 || len(node.Authors) != 0 {
+						t.Errorf("%s: %s = %d files, %d lines, %d children, authors %+v; want %d files and nothing else",
+							name, dir.name, node.Files, node.Total, len(node.Children), node.Authors, dir.files)
+					}
+				}
+				if !showFiles && !noBlame && (tree.Files != 4 || tree.Total != 1) {
+					t.Errorf("%s: root has %d files, %d lines; want 4 files, 1 line", name, tree.Files, tree.Total)
+				}
+			}
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	repo := statsRepo(t)
+	tests := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{"tree order", Options{}, []string{"README.md", "docs/guide.md", "src/deep/nested/gen.go", "src/main.go", "src/util.go"}},
+		{"dirs first", Options{DirsFirst: true}, []string{"docs/guide.md", "src/deep/nested/gen.go", "src/main.go", "src/util.go", "README.md"}},
+		{"breadth first", Options{BreadthFirst: true}, []string{"README.md", "docs/guide.md", "src/main.go", "src/util.go", "src/deep/nested/gen.go"}},
+		{"depth", Options{Depth: 2}, []string{"README.md", "docs/guide.md", "src/main.go", "src/util.go"}},
+		{"patterns", Options{Patterns: []string{"src/"}}, []string{"README.md", "docs/guide.md"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths, err := Files(context.Background(), repo.dir, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, path := range paths {
+				rel, _ := filepath.Rel(repo.dir, path)
+				got = append(got, filepath.ToSlash(rel))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Files() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWalkBlameCalls(t *testing.T) {
+	repo := statsRepo(t)
+	blames := countBlames(t)
+	tests := []struct {
+		name string
+		opts Options
+		want int
+	}{
+		// The binary logo.png is never blamed
+		{"blame", Options{}, 5},
+		{"no blame", Options{NoBlame: true, MinLines: 2}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := blames()
+			if _, err := Walk(context.Background(), repo.dir, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			if got := blames() - before; got != tt.want {
+				t.Errorf("%d blame calls, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWalkBlameOrder(t *testing.T) {
+	repo := statsRepo(t)
+	tests := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{"depth first", Options{}, []string{"README.md", "docs/guide.md", "src/deep/nested/gen.go", "src/main.go", "src/util.go"}},
+		{"breadth first", Options{BreadthFirst: true}, []string{"README.md", "docs/guide.md", "src/main.go", "src/util.go", "src/deep/nested/gen.go"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A single job blames the files in the order they were queued
+			var got []string
+			opts := tt.opts
+			opts.Jobs = 1
+			opts.OnFile = func(path string, authors []AuthorStat) {
+				rel, _ := filepath.Rel(repo.dir, path)
+				got = append(got, filepath.ToSlash(rel))
+			}
+			if _, err := Walk(context.Background(), repo.dir, opts); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("blame order %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWalkProgress(t *testing.T) {
+	repo := statsRepo(t)
+	var calls []string
+	_, err := Walk(context.Background(), repo.dir, Options{Jobs: 3, OnProgress: func(done, total int) {
+		calls = append(calls, fmt.Sprintf("%d/%d", done, total))
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The binary logo.png isn't blamed, so isn't counted
+	if want := []string{"1/5", "2/5", "3/5", "4/5", "5/5"}; !slices.Equal(calls, want) {
+		t.Errorf("progress %q, want %q", calls, want)
+	}
+}
+
+func TestWalkNoBlameOutsideRepo(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("1\n2\n3\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "b.txt"), []byte("1\n"), 0o644)
+	tree, err := Walk(context.Background(), dir, Options{NoBlame: true, ShowFiles: true, MinLines: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Children) != 1 || tree.Children[0].Name != "a.txt" || tree.Children[0].Total != 3 {
+		t.Errorf("children %+v, want a.txt with 3 lines", tree.Children)
+	}
+}
+
+func TestWalkCancelled(t *testing.T) {
+	repo := statsRepo(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if _, err := Walk(ctx, repo.dir, Options{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Walk() = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancelled walk took %v", elapsed)
+	}
+}
+
+func TestWalkCancelledMidWalk(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the git wrapper is a shell script")
+	}
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found")
+	}
+	repo := statsRepo(t)
+
+	// The first blame waits for two more to start, which then hang until
+	// they're killed, so cancelling as the first file finishes leaves two
+	// git processes to clean up
+	bin := t.TempDir()
+	pids := filepath.Join(bin, "pids")
+	script := fmt.Sprintf(`#!/bin/sh
+case " $* " in
+*" blame "*)
+	echo $$ >> %[1]q
+	if ! mkdir %[2]q 2>/dev/null; then
+		exec sleep 60
+	fi
+	for i in $(seq 100); do
+		[ "$(wc -l < %[1]q)" -ge 3 ] && break
+		sleep 0.05
+	done
+	;;
+esac
+exec %[3]q "$@"
+`, pids, filepath.Join(bin, "first"), realGit)
+	if err := os.WriteFile(filepath.Join(bin, "git"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	_, err = Walk(ctx, repo.dir, Options{Jobs: 3, OnFile: func(string, []AuthorStat) { cancel() }})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Walk() = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancelled walk took %v", elapsed)
+	}
+
+	data, _ := os.ReadFile(pids)
+	started := strings.Fields(string(data))
+	if len(started) < 3 {
+		t.Fatalf("%d blames started, want 3", len(started))
+	}
+	for _, field := range started {
+		pid, _ := strconv.Atoi(field)
+		if process, err := os.FindProcess(pid); err == nil && process.Signal(syscall.Signal(0)) == nil {
+			t.Errorf("git process %d still running", pid)
+		}
+	}
+}
+
+func TestWalkMaxFiles(t *testing.T) {
+	repo := statsRepo(t)
+	tests := []struct {
+		max     int
+		wantErr bool
+	}{
+		{0, false},
+		{5, false},
+		{4, true},
+	}
+	for _, tt := range tests {
+		_, err := Walk(context.Background(), repo.dir, Options{MaxFiles: tt.max, Jobs: 1})
+		if got := errors.Is(err, ErrTooManyFiles); got != tt.wantErr {
+			t.Errorf("MaxFiles %d: error %v, want too many files %v", tt.max, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWalkBlameFailure(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.commit("alice@x.org", map[string]string{"a.go": "a\n"})
+	repo.write("untracked.go", "u\n")
+
+	var failed []string
+	tree, err := Walk(context.Background(), repo.dir, Options{
+		ShowFiles: true,
+		OnBlameError: func(path string, err error) {
+			failed = append(failed, filepath.Base(path))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(failed, []string{"untracked.go"}) {
+		t.Errorf("blame failed on %q, want [untracked.go]", failed)
+	}
+	if len(tree.Children) != 1 || tree.Children[0].Name != "a.go" || tree.Children[0].Total != 1 {
+		t.Errorf("children %+v, want a.go alone with 1 line", tree.Children)
+	}
+}
+
+func TestWalkSymlinkLoop(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "a", "b"), 0o755)
+	os.WriteFile(filepath.Join(dir, "a", "b", "f.txt"), []byte("x\n"), 0o644)
+	if err := os.Symlink(filepath.Join(dir, "a"), filepath.Join(dir, "a", "b", "loop")); err != nil {
+		t.Skip("symlinks unsupported:", err)
+	}
+	os.Symlink(filepath.Join(dir, "a", "b"), filepath.Join(dir, "link"))
+
+	tests := []struct {
+		name   string
+		follow bool
+		want   []string
+	}{
+		{"listed", false, []string{"a/b/f.txt", "a/b/loop", "link"}},
+		{"followed", true, []string{"a/b/f.txt", "link/f.txt", "link/loop/b/f.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := walkedNames(t, dir, Options{FollowSymlinks: tt.follow}); !slices.Equal(got, tt.want) {
+				t.Errorf("walked %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkWalk(b *testing.B) {
+	if _, err := exec.LookPath("git"); err != nil {
+		b.Skip("git not found")
+	}
+	dir := b.TempDir()
+	run := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_CONFIG_GLOBAL="+os.DevNull, "GIT_CONFIG_NOSYSTEM=1")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			b.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, output)
+		}
+	}
+	run("init", "-q")
+	for i := range 50 {
+		path := filepath.Join(dir, fmt.Sprintf("pkg%d", i%5), fmt.Sprintf("f%d.go", i))
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		os.WriteFile(path, []byte(strings.Repeat("line\n", 100)), 0o644)
+	}
+	run("add", "-A")
+	run("-c", "user.name=bench", "-c", "user.email=bench@x.org", "commit", "-q", "-m", "bench")
+
+	b.ResetTimer()
+	for range b.N {
+		if _, err := Walk(context.Background(), dir, Options{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestBlamePaths(t *testing.T) {
+	repo := statsRepo(t)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(repo.dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	tree, err := BlamePaths(context.Background(), []string{"src/util.go", "logo.png", "docs/guide.md"}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `./ [0] (0)
+  src/util.go (4): alice@a.org 2, bob@b.org 2
+  logo.png binary (0)
+  docs/guide.md (3): bob@b.org 3
+`
+	if got := describe(tree); got != want {
+		t.Errorf("tree:\n%s\nwant:\n%s", got, want)
+	}
+
+	for _, paths := range [][]string{{"missing.go"}, {"src"}} {
+		if _, err := BlamePaths(context.Background(), paths, Options{}); err == nil {
+			t.Errorf("BlamePaths(%q) succeeded", paths)
+		}
+	}
+}
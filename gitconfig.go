@@ -0,0 +1,261 @@
+package filetree
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// GitDir returns the git directory of the repository containing dir, found
+// as git does by looking for .git in dir and each directory above it. A .git
+// file, as in a linked work tree or a submodule, points to the directory. ok
+// is false outside a repository.
+func GitDir(dir string) (gitDir string, ok bool) {
+	_, gitDir, ok = findRepo(dir)
+	return gitDir, ok
+}
+
+// findRepo returns the root of the work tree containing dir and its git
+// directory. Symlinks in dir are resolved first, as git resolves them in its
+// working directory. The ignore rules read this and git's configuration
+// directly rather than running git, so walking without blame works where
+// git isn't installed.
+func findRepo(dir string) (workTree, gitDir string, ok bool) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", "", false
+	}
+	if resolved, err := filepath.EvalSymlinks(absDir); err == nil {
+		absDir = resolved
+	}
+	for dir = absDir; ; {
+		dotGit := filepath.Join(dir, ".git")
+		if fileInfo, err := os.Stat(dotGit); err == nil {
+			if fileInfo.IsDir() {
+				return dir, dotGit, true
+			}
+			if gitDir, ok := readGitFile(dotGit); ok {
+				return dir, gitDir, true
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", false
+		}
+		dir = parent
+	}
+}
+
+// readGitFile returns the git directory a .git file points to with its
+// "gitdir: " line, which may be relative to the file.
+func readGitFile(path string) (string, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	gitDir, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "gitdir: ")
+	if !ok {
+		return "", false
+	}
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(filepath.Dir(path), gitDir)
+	}
+	return filepath.Clean(gitDir), true
+}
+
+// gitConfigFiles returns the configuration files git reads for the repository
+// with the given git directory, in increasing precedence: the system file,
+// the global files and the repository's own. An empty gitDir leaves out the
+// repository's file, as outside a repository. The system file is taken to be
+// /etc/gitconfig, git's location for it on most systems.
+func gitConfigFiles(gitDir string) []string {
+	var files []string
+	if os.Getenv("GIT_CONFIG_NOSYSTEM") == "" {
+		system := os.Getenv("GIT_CONFIG_SYSTEM")
+		if system == "" {
+			system = "/etc/gitconfig"
+		}
+		files = append(files, system)
+	}
+	if global := os.Getenv("GIT_CONFIG_GLOBAL"); global != "" {
+		files = append(files, global)
+	} else {
+		if configHome := os.Getenv("XDG_CONFIG_HOME"); configHome != "" {
+			files = append(files, filepath.Join(configHome, "git", "config"))
+		}
+		if home, err := os.UserHomeDir(); err == nil {
+			if os.Getenv("XDG_CONFIG_HOME") == "" {
+				files = append(files, filepath.Join(home, ".config", "git", "config"))
+			}
+			files = append(files, filepath.Join(home, ".gitconfig"))
+		}
+	}
+	if gitDir != "" {
+		// A linked work tree shares the configuration of the main one
+		commonDir := gitDir
+		if data, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+			commonDir = strings.TrimSpace(string(data))
+			if !filepath.IsAbs(commonDir) {
+				commonDir = filepath.Join(gitDir, commonDir)
+			}
+		}
+		files = append(files, filepath.Join(commonDir, "config"))
+	}
+	return files
+}
+
+// gitConfig returns the value of key, such as "core.excludesfile", set last
+// in the configuration files for the repository with the given git
+// directory. Section and variable names are matched ignoring case, as in
+// git, and subsections exactly.
+func gitConfig(gitDir, key string) (string, bool) {
+	section, rest, _ := strings.Cut(key, ".")
+	key = strings.ToLower(section) + "." + rest
+	if i := strings.LastIndexByte(key, '.'); i > len(section) {
+		key = key[:i] + strings.ToLower(key[i:])
+	} else {
+		key = strings.ToLower(key)
+	}
+	var value string
+	var found bool
+	for _, path := range gitConfigFiles(gitDir) {
+		readGitConfig(path, key, 0, &value, &found)
+	}
+	return value, found
+}
+
+// maxIncludeDepth bounds include.path chains, as git does, so a file that
+// includes itself isn't read forever.
+const maxIncludeDepth = 10
+
+// readGitConfig reads the git configuration file at path, setting value to
+// each value of key it assigns and following include.path directives. A
+// missing or unreadable file sets nothing. Conditional includes aren't
+// followed.
+func readGitConfig(path, key string, depth int, value *string, found *bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// A trailing backslash continues the value on the next line
+		for strings.HasSuffix(line, `\`) && !strings.HasSuffix(line, `\\`) && scanner.Scan() {
+			line = line[:len(line)-1] + scanner.Text()
+		}
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 {
+				return
+			}
+			section = gitConfigSection(line[1:end])
+			line = strings.TrimSpace(line[end+1:])
+			if line == "" || line[0] == '#' || line[0] == ';' {
+				continue
+			}
+		}
+
+		name, raw, hasValue := strings.Cut(line, "=")
+		name = section + "." + strings.ToLower(strings.TrimSpace(name))
+		v := "true"
+		if hasValue {
+			v = gitConfigValue(raw)
+		}
+		switch {
+		case name == key:
+			*value, *found = v, true
+		case name == "include.path" && hasValue && depth < maxIncludeDepth:
+			include, err := expandHome(v)
+			if err != nil {
+				continue
+			}
+			if !filepath.IsAbs(include) {
+				include = filepath.Join(filepath.Dir(path), include)
+			}
+			readGitConfig(include, key, depth+1, value, found)
+		}
+	}
+}
+
+// gitConfigSection returns the key prefix of a section header's contents:
+// the section name in lower case, followed by its subsection, which keeps
+// its case, as in `core` or `remote "origin"`.
+func gitConfigSection(header string) string {
+	name, subsection, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok {
+		// The deprecated [section.subsection] form
+		name, subsection, ok = strings.Cut(name, ".")
+		if !ok {
+			return strings.ToLower(name)
+		}
+		return strings.ToLower(name) + "." + strings.ToLower(subsection)
+	}
+	subsection = strings.TrimSpace(subsection)
+	subsection = strings.TrimSuffix(strings.TrimPrefix(subsection, `"`), `"`)
+	subsection = strings.NewReplacer(`\\`, `\`, `\"`, `"`).Replace(subsection)
+	return strings.ToLower(name) + "." + subsection
+}
+
+// gitConfigValue decodes the raw text after a key's "=": surrounding space is
+// dropped, double quotes preserve space and comment characters, backslash
+// escapes are replaced and a comment outside quotes ends the value.
+func gitConfigValue(raw string) string {
+	var b strings.Builder
+	quoted := false
+	// Space is only kept once something follows it
+	pending := ""
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+			continue
+		case c == '\\' && i+1 < len(raw):
+			i++
+			switch raw[i] {
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			default:
+				c = raw[i]
+			}
+		case !quoted && (c == '#' || c == ';'):
+			return b.String()
+		case !quoted && (c == ' ' || c == '\t'):
+			if b.Len() > 0 {
+				pending += string(c)
+			}
+			continue
+		}
+		b.WriteString(pending)
+		pending = ""
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// parseGitBool interprets a configuration value as git does for --type=bool.
+func parseGitBool(value string) (bool, bool) {
+	switch strings.ToLower(value) {
+	case "true", "yes", "on":
+		return true, true
+	case "false", "no", "off", "":
+		return false, true
+	}
+	if n, err := strconv.Atoi(value); err == nil {
+		return n != 0, true
+	}
+	return false, false
+}
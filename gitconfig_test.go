@@ -0,0 +1,98 @@
+package filetree
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGitConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write("included", "[core]\n\tignoreCase = yes\n")
+	t.Setenv("GIT_CONFIG_GLOBAL", write("global", "[Core]\n\texcludesFile = ~/global-ignore\n\tattributesFile = x\n[include]\n\tpath = included\n"))
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	gitDir := filepath.Join(dir, "repo.git")
+	os.Mkdir(gitDir, 0o755)
+	os.WriteFile(filepath.Join(gitDir, "config"), []byte(`[core]
+	excludesfile = "my ignore" ; a comment
+[remote "Origin"] url = x
+[core.sub]
+	bare
+`), 0o644)
+
+	tests := []struct {
+		gitDir, key string
+		want        string
+		found       bool
+	}{
+		{"", "core.excludesFile", "~/global-ignore", true},
+		{gitDir, "core.excludesFile", "my ignore", true},
+		{gitDir, "core.ignorecase", "yes", true},
+		{gitDir, `remote.Origin.url`, "x", true},
+		{gitDir, "remote.origin.url", "", false},
+		{gitDir, "core.sub.bare", "true", true},
+		{gitDir, "core.bare", "", false},
+	}
+	for _, tt := range tests {
+		if got, found := gitConfig(tt.gitDir, tt.key); got != tt.want || found != tt.found {
+			t.Errorf("gitConfig(%q, %q) = %q, %v; want %q, %v", tt.gitDir, tt.key, got, found, tt.want, tt.found)
+		}
+	}
+}
+
+func TestGitConfigValue(t *testing.T) {
+	tests := []struct {
+		raw, want string
+	}{
+		{" plain ", "plain"},
+		{" two  words\t# comment", "two  words"},
+		{` "quoted # not a comment " `, "quoted # not a comment "},
+		{` a\tb\\c\"d`, "a\tb\\c\"d"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := gitConfigValue(tt.raw); got != tt.want {
+			t.Errorf("gitConfigValue(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestFindRepo(t *testing.T) {
+	root := t.TempDir()
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	main := filepath.Join(root, "main")
+	linked := filepath.Join(root, "linked")
+	for _, dir := range []string{filepath.Join(main, ".git", "worktrees", "linked"), filepath.Join(main, "a", "b"), filepath.Join(linked, "c")} {
+		os.MkdirAll(dir, 0o755)
+	}
+	os.WriteFile(filepath.Join(linked, ".git"), []byte("gitdir: ../main/.git/worktrees/linked\n"), 0o644)
+
+	tests := []struct {
+		dir              string
+		workTree, gitDir string
+		ok               bool
+	}{
+		{main, main, filepath.Join(main, ".git"), true},
+		{filepath.Join(main, "a", "b"), main, filepath.Join(main, ".git"), true},
+		{filepath.Join(linked, "c"), linked, filepath.Join(main, ".git", "worktrees", "linked"), true},
+		{root, "", "", false},
+	}
+	for _, tt := range tests {
+		workTree, gitDir, ok := findRepo(tt.dir)
+		if workTree != tt.workTree || gitDir != tt.gitDir || ok != tt.ok {
+			t.Errorf("findRepo(%q) = %q, %q, %v; want %q, %q, %v", tt.dir, workTree, gitDir, ok, tt.workTree, tt.gitDir, tt.ok)
+		}
+	}
+	if got := repoPrefix(filepath.Join(main, "a", "b")); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("repoPrefix = %q, want [a b]", got)
+	}
+}
@@ -0,0 +1,60 @@
+package filetree
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// goGitBlame blames path in-process as of opts.Ref, or HEAD, using go-git.
+// Lines changed in the working tree are blamed as they were committed.
+func goGitBlame(ctx context.Context, path string, opts BlameOptions) ([]blameLine, error) {
+	repo, err := git.PlainOpenWithOptions(existingDir(filepath.Dir(path)), &git.PlainOpenOptions{
+		DetectDotGit:          true,
+		EnableDotGitCommonDir: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	relPath, err := filepath.Rel(worktree.Filesystem.Root(), path)
+	if err != nil {
+		return nil, err
+	}
+
+	rev := opts.Ref
+	if rev == "" {
+		rev = "HEAD"
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	result, err := git.Blame(commit, filepath.ToSlash(relPath))
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]blameLine, len(result.Lines))
+	for i, line := range result.Lines {
+		lines[i] = blameLine{
+			commit:     line.Hash.String(),
+			authorName: line.AuthorName,
+			authorMail: line.Author,
+			authorTime: line.Date,
+		}
+	}
+	return lines, ctx.Err()
+}
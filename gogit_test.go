@@ -0,0 +1,36 @@
+package filetree
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestGoGitBackendMatchesGit(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.commit("alice@x.org", map[string]string{"f.go": "a\nb\nc\n"})
+	repo.commit("bob@x.org", map[string]string{"f.go": "a\nB\nc\nd\n"})
+	path := filepath.Join(repo.dir, "f.go")
+
+	for _, metric := range []string{MetricLines, MetricCommits} {
+		want, err := FileContributions(context.Background(), path, BlameOptions{Metric: metric})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := FileContributions(context.Background(), path, BlameOptions{Metric: metric, Backend: BackendGoGit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Total != want.Total || len(got.Counts) != len(want.Counts) {
+			t.Fatalf("%s: go-git counts %v, git counts %v", metric, got.Counts, want.Counts)
+		}
+		for author, count := range want.Counts {
+			if got.Counts[author] != count {
+				t.Errorf("%s: go-git counts %v, git counts %v", metric, got.Counts, want.Counts)
+			}
+		}
+		if !got.Latest.Equal(want.Latest) {
+			t.Errorf("%s: go-git latest %v, git latest %v", metric, got.Latest, want.Latest)
+		}
+	}
+}
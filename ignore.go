@@ -0,0 +1,499 @@
+package filetree
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// GitDirPattern matches the .git directory, which is never listed in
+// .gitignore itself but is almost never wanted in the tree.
+const GitDirPattern = ".git"
+
+// GeneratedPatterns match commonly committed generated files, such as
+// compiled protobufs, minified assets and lock files. They are ignored with
+// --ignore-generated unless .filetree.toml sets its own list.
+var GeneratedPatterns = []string{
+	"*.pb.go",
+	"*_generated.go",
+	"*.gen.go",
+	"*_pb2.py",
+	"*.min.js",
+	"*.min.css",
+	"*.map",
+	"package-lock.json",
+	"yarn.lock",
+	"pnpm-lock.yaml",
+	"go.sum",
+	"Cargo.lock",
+	"poetry.lock",
+	"composer.lock",
+	"Gemfile.lock",
+}
+
+// IgnoreFile is the name of the filetree-only ignore file. It uses gitignore
+// syntax but, unlike .gitignore, doesn't affect git.
+const IgnoreFile = ".filetreeignore"
+
+// PatternError describes a malformed pattern, which is left out rather than
+// failing the walk.
+type PatternError struct {
+	// Path is the file the pattern was read from, or the flag that gave it
+	Path string
+	// Line is the pattern's line in Path, or zero if it wasn't read from a
+	// line of its own, as in a TOML array
+	Line    int
+	Pattern string
+	Err     error
+}
+
+func (e *PatternError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: invalid pattern %q: %v", e.Path, e.Pattern, e.Err)
+	}
+	return fmt.Sprintf("%s:%d: invalid pattern %q: %v", e.Path, e.Line, e.Pattern, e.Err)
+}
+
+func (e *PatternError) Unwrap() error {
+	return e.Err
+}
+
+// loadGitignore reads the patterns in the gitignore-style file at path.
+// Malformed patterns are reported to onBadPattern, if non-nil, as a
+// *PatternError and left out.
+func loadGitignore(path string, onBadPattern func(error)) ([]string, error) {
+	var patterns []string
+
+	file, err := os.Open(path)
+	if err != nil {
+		// Return an empty slice if .gitignore doesn't exist
+		if os.IsNotExist(err) {
+			return patterns, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		// Editors on Windows may save the file with a byte order mark and
+		// CRLF line endings
+		if lineNumber == 1 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		line = trimTrailingSpace(strings.TrimLeft(strings.TrimSuffix(line, "\r"), " \t"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := validatePattern(line); err != nil {
+			if onBadPattern != nil {
+				onBadPattern(&PatternError{Path: path, Line: lineNumber, Pattern: line, Err: err})
+			}
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return patterns, nil
+}
+
+// validatePattern checks that every segment of pattern is a valid glob, as a
+// malformed one, such as an unclosed "[", would otherwise never match.
+func validatePattern(pattern string) error {
+	pattern = translateClasses(strings.TrimSuffix(strings.TrimPrefix(pattern, "!"), "/"))
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidPatterns returns the valid patterns among patterns, reporting each
+// malformed one to onBadPattern, if non-nil, as a *PatternError from source.
+func ValidPatterns(source string, patterns []string, onBadPattern func(error)) []string {
+	valid := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if err := validatePattern(pattern); err != nil {
+			if onBadPattern != nil {
+				onBadPattern(&PatternError{Path: source, Pattern: pattern, Err: err})
+			}
+			continue
+		}
+		valid = append(valid, pattern)
+	}
+	return valid
+}
+
+// trimTrailingSpace removes the whitespace at the end of a gitignore line,
+// except for a space escaped with a backslash, which is part of the pattern.
+func trimTrailingSpace(line string) string {
+	for strings.HasSuffix(line, " ") || strings.HasSuffix(line, "\t") {
+		trimmed := line[:len(line)-1]
+		// The space is escaped if an odd number of backslashes precede it
+		backslashes := len(trimmed) - len(strings.TrimRight(trimmed, "\\"))
+		if backslashes%2 == 1 {
+			break
+		}
+		line = trimmed
+	}
+	return line
+}
+
+// LoadIgnorePatterns loads the ignore patterns from git's global excludes
+// file, the .gitignore and .filetreeignore of dir and of each directory above
+// it up to the root of its repository, and dir's .filetree.toml, in
+// increasing precedence. A path matching any of them is ignored unless a
+// later negated pattern re-includes it. Patterns from directories above dir
+// are rewritten to match paths relative to dir.
+//
+// configPath is the configuration file to read patterns from instead of
+// dir's .filetree.toml; empty means the latter. Malformed patterns are
+// reported to onBadPattern as for Options.OnBadPattern.
+func LoadIgnorePatterns(dir, configPath string, onBadPattern func(error)) ([]string, error) {
+	var allPatterns []string
+
+	// Load global core.excludesFile patterns
+	excludesPath, err := globalExcludesFile(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error locating core.excludesFile: %v", err)
+	}
+	if excludesPath != "" {
+		globalPatterns, err := loadGitignore(excludesPath, onBadPattern)
+		if err != nil {
+			return nil, fmt.Errorf("error loading %s: %v", excludesPath, err)
+		}
+		allPatterns = append(allPatterns, globalPatterns...)
+	}
+
+	// Load .gitignore and .filetreeignore patterns from the repository
+	// root down to dir, so deeper files take precedence as in git
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	prefix := repoPrefix(dir)
+	for i := range len(prefix) + 1 {
+		levelDir := absDir
+		for range len(prefix) - i {
+			levelDir = filepath.Dir(levelDir)
+		}
+
+		gitPatterns, err := loadGitignore(filepath.Join(levelDir, ".gitignore"), onBadPattern)
+		if err != nil {
+			return nil, fmt.Errorf("error loading .gitignore: %v", err)
+		}
+		filetreePatterns, err := loadGitignore(filepath.Join(levelDir, IgnoreFile), onBadPattern)
+		if err != nil {
+			return nil, fmt.Errorf("error loading %s: %v", IgnoreFile, err)
+		}
+		for _, pattern := range append(gitPatterns, filetreePatterns...) {
+			allPatterns = append(allPatterns, rebasePattern(pattern, prefix[i:])...)
+		}
+	}
+
+	// Load .filetree.toml patterns
+	if configPath == "" {
+		configPath = filepath.Join(dir, ConfigFile)
+	}
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading %s: %v", configPath, err)
+	}
+	if onBadPattern != nil {
+		for _, err := range cfg.badPatterns {
+			onBadPattern(err)
+		}
+	}
+	allPatterns = append(allPatterns, ValidPatterns(configPath, cfg.IgnorePatterns(), onBadPattern)...)
+
+	return allPatterns, nil
+}
+
+// repoPrefix returns the directories leading from the root of the
+// repository containing dir down to dir, or nil if dir is the root or not in
+// a repository.
+func repoPrefix(dir string) []string {
+	workTree, _, ok := findRepo(dir)
+	if !ok {
+		return nil
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil
+	}
+	if resolved, err := filepath.EvalSymlinks(absDir); err == nil {
+		absDir = resolved
+	}
+	prefix, err := filepath.Rel(workTree, absDir)
+	if err != nil || prefix == "." {
+		return nil
+	}
+	return strings.Split(filepath.ToSlash(prefix), "/")
+}
+
+// rebasePattern rewrites pattern, read from the ignore file of a directory
+// above the walk root, to match paths relative to the walk root, which is
+// reached from that directory through prefix. A pattern without a slash
+// matches at any depth and is kept as is. An anchored pattern is kept only if
+// its leading segments can match prefix, without them; a "**" segment may
+// consume any number of prefix directories, so it can yield several
+// patterns. A pattern that matches the walk root itself, or a directory
+// above it, is dropped, as the walk root is never ignored.
+func rebasePattern(pattern string, prefix []string) []string {
+	if len(prefix) == 0 {
+		return []string{pattern}
+	}
+	negation := ""
+	if strings.HasPrefix(pattern, "!") {
+		negation, pattern = "!", pattern[1:]
+	}
+	dirOnly := strings.HasSuffix(pattern, "/")
+	trimmed := strings.TrimSuffix(pattern, "/")
+	if !strings.Contains(trimmed, "/") {
+		return []string{negation + pattern}
+	}
+
+	var rebased []string
+	var rebase func(segments, prefix []string)
+	rebase = func(segments, prefix []string) {
+		if len(prefix) == 0 {
+			if len(segments) == 0 {
+				return
+			}
+			p := "/" + strings.Join(segments, "/")
+			if dirOnly {
+				p += "/"
+			}
+			rebased = append(rebased, negation+p)
+			return
+		}
+		if len(segments) == 0 {
+			return
+		}
+		if segments[0] == "**" {
+			// The "**" either ends before the next prefix directory or
+			// covers it too
+			rebase(segments[1:], prefix)
+			rebase(segments, prefix[1:])
+			return
+		}
+		if matched, _ := path.Match(translateClasses(segments[0]), prefix[0]); matched {
+			rebase(segments[1:], prefix[1:])
+		}
+	}
+	rebase(strings.Split(strings.TrimPrefix(trimmed, "/"), "/"), prefix)
+	return rebased
+}
+
+// globalExcludesFile returns the path of git's global ignore file, as set by
+// core.excludesFile or else the XDG default of $XDG_CONFIG_HOME/git/ignore.
+// An empty path means there is no file to load.
+func globalExcludesFile(dir string) (string, error) {
+	_, gitDir, _ := findRepo(dir)
+	if excludesPath, ok := gitConfig(gitDir, "core.excludesFile"); ok && excludesPath != "" {
+		return expandHome(excludesPath)
+	}
+
+	if configHome := os.Getenv("XDG_CONFIG_HOME"); configHome != "" {
+		return filepath.Join(configHome, "git", "ignore"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", nil
+	}
+	return filepath.Join(home, ".config", "git", "ignore"), nil
+}
+
+// IgnoreCaseConfigured reports whether git's core.ignorecase is set for the
+// repository containing dir, as git init does on case-insensitive
+// filesystems.
+func IgnoreCaseConfigured(dir string) bool {
+	_, gitDir, _ := findRepo(dir)
+	value, ok := gitConfig(gitDir, "core.ignorecase")
+	ignoreCase, _ := parseGitBool(value)
+	return ok && ignoreCase
+}
+
+// expandHome replaces a leading "~/" in path with the user's home directory.
+func expandHome(path string) (string, error) {
+	rest, ok := strings.CutPrefix(path, "~/")
+	if !ok {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, rest), nil
+}
+
+// MatchesGitignore reports whether relPath, a path relative to the walk root,
+// is ignored by the given patterns. Patterns are evaluated in order and the
+// last matching one wins, so a negated pattern ("!foo") can re-include a path
+// excluded by an earlier pattern. A relPath ending in a slash names a
+// directory; any other names a file, which a directory pattern such as
+// "build/" only matches through its parent directories.
+func MatchesGitignore(relPath string, patterns []string) bool {
+	relPath = filepath.ToSlash(relPath)
+	isDir := strings.HasSuffix(relPath, "/")
+	_, ignored := lastMatch(strings.TrimSuffix(relPath, "/"), isDir, patterns)
+	return ignored
+}
+
+// foldPatterns returns patterns lowercased, for matching against lowercased
+// paths regardless of case.
+func foldPatterns(patterns []string) []string {
+	folded := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		folded[i] = strings.ToLower(pattern)
+	}
+	return folded
+}
+
+// lastMatch evaluates patterns against a slash-separated relPath, which is a
+// directory if isDir is set, reporting whether any pattern matched and
+// whether the last match ignores the path.
+func lastMatch(relPath string, isDir bool, patterns []string) (matched, ignored bool) {
+	for _, pattern := range patterns {
+		negate := strings.HasPrefix(pattern, "!")
+		if negate {
+			pattern = pattern[1:]
+		}
+		if matchPattern(pattern, relPath, isDir) {
+			matched, ignored = true, !negate
+		}
+	}
+	return matched, ignored
+}
+
+// patternScope is a set of ignore patterns that applies beneath base, a
+// slash-separated path relative to the walk root ("" for the root itself).
+type patternScope struct {
+	base     string
+	patterns []string
+}
+
+// matchesScopes reports whether relPath is ignored by scopes, which are
+// ordered from the root down. Patterns in deeper scopes are matched against
+// the path relative to their own directory and take precedence.
+func matchesScopes(relPath string, isDir bool, scopes []patternScope) bool {
+	relPath = filepath.ToSlash(relPath)
+	ignored := false
+	for _, scope := range scopes {
+		scoped := relPath
+		if scope.base != "" {
+			scoped = strings.TrimPrefix(relPath, scope.base+"/")
+		}
+		if matched, scopeIgnored := lastMatch(scoped, isDir, scope.patterns); matched {
+			ignored = scopeIgnored
+		}
+	}
+	return ignored
+}
+
+// matchPattern reports whether a single pattern, stripped of any negation,
+// matches relPath or one of its parent directories. A pattern with a leading
+// or middle slash is anchored to the root of its scope; any other pattern
+// matches a name at any depth. Within anchored patterns a leading "**/"
+// matches in all directories, a trailing "/**" matches everything inside, and
+// a middle "/**/" matches zero or more directories. A pattern with a trailing
+// slash only matches directories, so it matches relPath itself only if isDir
+// is set.
+func matchPattern(pattern, relPath string, isDir bool) bool {
+	// A trailing slash marks a directory pattern, which also covers
+	// everything beneath the directory
+	dirOnly := strings.HasSuffix(pattern, "/")
+	pattern = translateClasses(strings.TrimSuffix(pattern, "/"))
+	if pattern == "" {
+		return false
+	}
+	segments := strings.Split(relPath, "/")
+	// Every segment but the last is a directory
+	candidate := func(n int) bool {
+		return !dirOnly || isDir || n < len(segments)
+	}
+
+	if !strings.Contains(pattern, "/") {
+		for i, segment := range segments {
+			if matched, _ := path.Match(pattern, segment); matched && candidate(i+1) {
+				return true
+			}
+		}
+		return false
+	}
+
+	patternSegments := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	for i := len(segments); i > 0; i-- {
+		if candidate(i) && matchSegments(patternSegments, segments[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// translateClasses rewrites the gitignore character classes in pattern in the
+// form path.Match expects: "[!...]" negates a class as "[^...]" does, and a
+// "]" first in a class is escaped.
+func translateClasses(pattern string) string {
+	if !strings.Contains(pattern, "[") {
+		return pattern
+	}
+	var b strings.Builder
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		b.WriteByte(c)
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteByte(pattern[i])
+		case c == '[' && !inClass:
+			inClass = true
+			if i+1 < len(pattern) && pattern[i+1] == '!' {
+				b.WriteByte('^')
+				i++
+			}
+			// A "]" straight after the opening bracket is part of the
+			// class, which path.Match needs escaped
+			if i+1 < len(pattern) && pattern[i+1] == ']' {
+				i++
+				b.WriteString(`\]`)
+			}
+		case c == ']' && inClass:
+			inClass = false
+		}
+	}
+	return b.String()
+}
+
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			if len(rest) == 0 {
+				return len(segments) > 0
+			}
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(rest, segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], segments[0]); !matched {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
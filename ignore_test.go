@@ -0,0 +1,414 @@
+package filetree
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func FuzzMatchesGitignore(f *testing.F) {
+	for _, seed := range []struct{ pattern, path string }{
+		{"*.log", "a/b.log"},
+		{"/build", "build/x"},
+		{"**/foo", "a/b/foo"},
+		{"a/**/b", "a/x/y/b"},
+		{"foo/**", "foo/bar"},
+		{"[!a-c]?.go", "dx.go"},
+		{"[]]x", "]x"},
+		{`\!important`, "!important"},
+		{"dir/", "dir/file"},
+		{"[unclosed", "x"},
+	} {
+		f.Add(seed.pattern, seed.path)
+	}
+	f.Fuzz(func(t *testing.T, pattern, path string) {
+		if strings.HasPrefix(pattern, "!") {
+			return
+		}
+		ignored := MatchesGitignore(path, []string{pattern})
+		// A negation of a pattern re-includes everything the pattern
+		// matched
+		if MatchesGitignore(path, []string{pattern, "!" + pattern}) {
+			t.Errorf("%q then %q ignores %q", pattern, "!"+pattern, path)
+		}
+		// A malformed pattern never matches, which is why it is reported
+		if ignored && validatePattern(pattern) != nil {
+			t.Errorf("invalid pattern %q ignores %q", pattern, path)
+		}
+	})
+}
+
+func TestValidPatterns(t *testing.T) {
+	var reported []string
+	valid := ValidPatterns("--exclude", []string{"*.go", "[bad", "a/[!b]", "x[", "[]]"}, func(err error) {
+		var patternErr *PatternError
+		if !errors.As(err, &patternErr) {
+			t.Fatalf("reported %T, want *PatternError", err)
+		}
+		reported = append(reported, err.Error())
+	})
+	if want := []string{"*.go", "a/[!b]", "[]]"}; !slices.Equal(valid, want) {
+		t.Errorf("valid = %q, want %q", valid, want)
+	}
+	want := []string{
+		`--exclude: invalid pattern "[bad": syntax error in pattern`,
+		`--exclude: invalid pattern "x[": syntax error in pattern`,
+	}
+	if !slices.Equal(reported, want) {
+		t.Errorf("reported %q, want %q", reported, want)
+	}
+}
+
+func TestLoadIgnorePatternsReportsConfigPatterns(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{"toml array", "ignore = [\"[bad\", \"ok\"]\n", `invalid pattern "[bad"`},
+		{"flat list", "ok\n[bad\n", `:2: invalid pattern "[bad"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, ConfigFile), []byte(tt.config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			var reported []string
+			patterns, err := LoadIgnorePatterns(dir, "", func(err error) { reported = append(reported, err.Error()) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(patterns, []string{"ok"}) {
+				t.Errorf("patterns = %q, want [ok]", patterns)
+			}
+			if len(reported) != 1 || !strings.Contains(reported[0], tt.want) {
+				t.Errorf("reported %q, want one error containing %q", reported, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchesGitignore(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		want     bool
+	}{
+		{"name at root", []string{"*.log"}, "debug.log", true},
+		{"name at depth", []string{"*.log"}, "a/b/debug.log", true},
+		{"name in parent", []string{"vendor"}, "vendor/x/y.go", true},
+		{"no match", []string{"*.log"}, "main.go", false},
+		{"negation", []string{"*.log", "!keep.log"}, "keep.log", false},
+		{"negation of others", []string{"*.log", "!keep.log"}, "drop.log", true},
+		{"negation then ignore", []string{"!keep.log", "*.log"}, "keep.log", true},
+		{"directory", []string{"build/"}, "build/out.o", true},
+		{"directory itself", []string{"build/"}, "build/", true},
+		{"directory pattern skips file", []string{"build/"}, "build", false},
+		{"directory pattern skips nested file", []string{"build/"}, "src/build", false},
+		{"directory prefix", []string{"build/"}, "buildtools/x.go", false},
+		{"anchored directory pattern skips file", []string{"/build/"}, "build", false},
+		{"anchored", []string{"/build"}, "build/x", true},
+		{"anchored not nested", []string{"/build"}, "src/build/x", false},
+		{"middle slash anchors", []string{"doc/api"}, "x/doc/api", false},
+		{"leading doublestar", []string{"**/foo"}, "a/b/foo", true},
+		{"leading doublestar at root", []string{"**/foo"}, "foo", true},
+		{"trailing doublestar", []string{"foo/**"}, "foo/bar/baz", true},
+		{"trailing doublestar not dir", []string{"foo/**"}, "foo", false},
+		{"middle doublestar none", []string{"a/**/b"}, "a/b", true},
+		{"middle doublestar several", []string{"a/**/b"}, "a/x/y/b", true},
+		{"middle doublestar elsewhere", []string{"a/**/b"}, "c/a/x/b", false},
+		{"question mark", []string{"?.txt"}, "ab.txt", false},
+		{"star stays in segment", []string{"/a*"}, "ab/c", true},
+		{"star never crosses slash", []string{"a*c"}, "ab/c", false},
+		{"malformed", []string{"[unclosed"}, "[unclosed", false},
+		{"range", []string{"tmp/[0-9]*"}, "tmp/42-cache", true},
+		{"range miss", []string{"tmp/[0-9]*"}, "tmp/cache", false},
+		{"negated class", []string{"[!a-c]?.go"}, "dx.go", true},
+		{"negated class miss", []string{"[!a-c]?.go"}, "ax.go", false},
+		{"caret class", []string{"[^a-c]?.go"}, "ax.go", false},
+		{"bracket in class", []string{"[]]x"}, "]x", true},
+		{"escaped bang", []string{`\!important`}, "!important", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MatchesGitignore(tt.path, tt.patterns); got != tt.want {
+				t.Errorf("MatchesGitignore(%q, %q) = %v, want %v", tt.path, tt.patterns, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchesScopes(t *testing.T) {
+	// The walk only matches a scope against paths beneath its base
+	scopes := []patternScope{
+		{base: "", patterns: []string{"*.tmp", "/gen"}},
+		{base: "sub", patterns: []string{"!keep.tmp", "/local"}},
+	}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"a.tmp", true},
+		{"sub/a.tmp", true},
+		{"sub/keep.tmp", false},
+		{"gen/x.go", true},
+		{"sub/gen/x.go", false},
+		{"sub/local/x.go", true},
+	}
+	for _, tt := range tests {
+		if got := matchesScopes(tt.path, false, scopes); got != tt.want {
+			t.Errorf("matchesScopes(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+// walkedNames walks dir without blame, listing files, and returns the
+// slash-separated paths of the files in the tree.
+func walkedNames(t *testing.T, dir string, opts Options) []string {
+	t.Helper()
+	opts.ShowFiles = true
+	opts.NoBlame = true
+	tree, err := Walk(context.Background(), dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	var visit func(n *Node, prefix string)
+	visit = func(n *Node, prefix string) {
+		for _, child := range n.Children {
+			if child.Type == NodeDir {
+				visit(child, prefix+child.Name+"/")
+				continue
+			}
+			names = append(names, prefix+child.Name)
+		}
+	}
+	visit(tree, "")
+	sort.Strings(names)
+	return names
+}
+
+func TestWalkDirectoryPatterns(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"build", "out/build/x.o", "src/build", "src/main.go"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		if err := os.WriteFile(path, []byte("x\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := walkedNames(t, dir, Options{Patterns: []string{"build/"}})
+	if want := []string{"build", "src/build", "src/main.go"}; !slices.Equal(got, want) {
+		t.Errorf("walked %q, want %q", got, want)
+	}
+}
+
+func TestRebasePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		prefix  []string
+		want    []string
+	}{
+		{"*.log", []string{"sub"}, []string{"*.log"}},
+		{"/build", nil, []string{"/build"}},
+		{"/sub/gen", []string{"sub"}, []string{"/gen"}},
+		{"sub/gen/", []string{"sub"}, []string{"/gen/"}},
+		{"!/sub/keep", []string{"sub"}, []string{"!/keep"}},
+		{"/other/gen", []string{"sub"}, nil},
+		{"/sub", []string{"sub"}, nil},
+		{"/s*/gen", []string{"sub"}, []string{"/gen"}},
+		{"**/gen", []string{"a", "b"}, []string{"/**/gen"}},
+		{"/a/**/x", []string{"a", "b"}, []string{"/**/x"}},
+	}
+	for _, tt := range tests {
+		got := rebasePattern(tt.pattern, tt.prefix)
+		slices.Sort(got)
+		want := slices.Clone(tt.want)
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			t.Errorf("rebasePattern(%q, %q) = %q, want %q", tt.pattern, tt.prefix, got, want)
+		}
+	}
+}
+
+func TestLoadGitignore(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		badLine int
+	}{
+		{"comments and blanks", "# comment\n\n*.log\n  \n", []string{"*.log"}, 0},
+		{"byte order mark", "\ufeff*.log\n", []string{"*.log"}, 0},
+		{"crlf", "*.log\r\nbuild/\r\n", []string{"*.log", "build/"}, 0},
+		{"trailing space", "*.log  \t\n", []string{"*.log"}, 0},
+		{"escaped trailing space", `name\ ` + "\n", []string{`name\ `}, 0},
+		{"escaped backslash before space", `name\\ ` + "\n", []string{`name\\`}, 0},
+		{"leading space", "  *.log\n", []string{"*.log"}, 0},
+		{"bad pattern", "ok\n\n[bad\nalso\n", []string{"ok", "also"}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ".gitignore")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			badLine := 0
+			patterns, err := loadGitignore(path, func(err error) {
+				var patternErr *PatternError
+				if errors.As(err, &patternErr) {
+					badLine = patternErr.Line
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(patterns, tt.want) {
+				t.Errorf("patterns = %q, want %q", patterns, tt.want)
+			}
+			if badLine != tt.badLine {
+				t.Errorf("bad pattern reported on line %d, want %d", badLine, tt.badLine)
+			}
+		})
+	}
+
+	patterns, err := loadGitignore(filepath.Join(t.TempDir(), "missing"), nil)
+	if err != nil || len(patterns) != 0 {
+		t.Errorf("missing file: patterns %q, error %v; want none", patterns, err)
+	}
+}
+
+func TestLoadIgnorePatternsSources(t *testing.T) {
+	repo := newTestRepo(t)
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	excludes := filepath.Join(t.TempDir(), "excludes")
+	if err := os.WriteFile(excludes, []byte("*.swp\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	repo.git("config", "core.excludesFile", excludes)
+	repo.write(".gitignore", "*.log\n/top-only\n/sub/gen/\n")
+	repo.write(IgnoreFile, "fixtures/\n")
+	repo.write("sub/.gitignore", "*.tmp\n")
+	repo.write("sub/"+ConfigFile, "ignore = [\"*.bak\"]\n")
+
+	tests := []struct {
+		dir  string
+		want []string
+	}{
+		{"", []string{"*.swp", "*.log", "/top-only", "/sub/gen/", "fixtures/"}},
+		{"sub", []string{"*.swp", "*.log", "/gen/", "fixtures/", "*.tmp", "*.bak"}},
+	}
+	for _, tt := range tests {
+		t.Run("dir "+tt.dir, func(t *testing.T) {
+			patterns, err := LoadIgnorePatterns(filepath.Join(repo.dir, tt.dir), "", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(patterns, tt.want) {
+				t.Errorf("patterns = %q, want %q", patterns, tt.want)
+			}
+		})
+	}
+}
+
+func TestWalkIgnores(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"main.go", "Debug.LOG", ".hidden", "build/out.o", "buildtools/t.go",
+		"src/build/b.go", "sub/.gitignore", "sub/a.tmp", "sub/keep.tmp", "sub/x.go",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		if err := os.WriteFile(path, []byte("x\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "sub", ".gitignore"), []byte("*.tmp\n!keep.tmp\n"), 0o644)
+	base := []string{"buildtools/t.go", "main.go", "src/build/b.go", "sub/keep.tmp", "sub/x.go"}
+
+	tests := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{"case sensitive", Options{Patterns: []string{"/build/", "*.log"}}, append([]string{"Debug.LOG"}, base...)},
+		{"ignore case", Options{Patterns: []string{"/BUILD/", "*.log"}, IgnoreCase: true}, base},
+		{"hidden", Options{Patterns: []string{"/build/", "*.log"}, ShowHidden: true, IgnoreCase: true},
+			[]string{".hidden", "buildtools/t.go", "main.go", "src/build/b.go", "sub/.gitignore", "sub/keep.tmp", "sub/x.go"}},
+		{"include only", Options{Patterns: []string{"/build/"}, IncludeOnly: []string{"*.go"}}, []string{"buildtools/t.go", "main.go", "src/build/b.go", "sub/x.go"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := walkedNames(t, dir, tt.opts); !slices.Equal(got, tt.want) {
+				t.Errorf("walked %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIgnoreCaseConfigured(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.write("sub/f.go", "x\n")
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"true", true},
+		{"yes", true},
+		{"false", false},
+	}
+	for _, tt := range tests {
+		repo.git("config", "core.ignorecase", tt.value)
+		if got := IgnoreCaseConfigured(filepath.Join(repo.dir, "sub")); got != tt.want {
+			t.Errorf("core.ignorecase %q: IgnoreCaseConfigured() = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+	if IgnoreCaseConfigured(t.TempDir()) {
+		t.Error("IgnoreCaseConfigured() outside a repository = true, want false")
+	}
+}
+
+func TestWalkRootSpellings(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"main.go", "build/out.o", "src/build/b.go"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		if err := os.WriteFile(path, []byte("x\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relative, err := filepath.Rel(wd, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Anchored patterns match relative to the root, and the root is named,
+	// the same however it is written
+	want := []string{"main.go", "src/build/b.go"}
+	for _, root := range []string{dir, dir + string(filepath.Separator), filepath.Join(dir, "src") + string(filepath.Separator) + "..", relative} {
+		opts := Options{Patterns: []string{"/build/"}}
+		if got := walkedNames(t, root, opts); !slices.Equal(got, want) {
+			t.Errorf("root %q: walked %q, want %q", root, got, want)
+		}
+		tree, err := Walk(context.Background(), root, Options{NoBlame: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tree.Name != filepath.Base(dir) {
+			t.Errorf("root %q: named %q, want %q", root, tree.Name, filepath.Base(dir))
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package filetree
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// limiter caps the number of git processes running at once. The cap starts
+// at the number of workers, halves whenever git fails for lack of processes
+// or file descriptors, and creeps back up by one after each run of as many
+// successes as the current cap.
+type limiter struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	limit     int
+	max       int
+	active    int
+	successes int
+}
+
+func newLimiter(max int) *limiter {
+	l := &limiter{limit: max, max: max}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire blocks until another git process may start.
+func (l *limiter) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+}
+
+// release records the outcome of a git process started after acquire and
+// adjusts the cap accordingly.
+func (l *limiter) release(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	switch {
+	case isResourceError(err):
+		l.limit = max(1, l.limit/2)
+		l.successes = 0
+	case err == nil:
+		l.successes++
+		if l.successes >= l.limit && l.limit < l.max {
+			l.limit++
+			l.successes = 0
+		}
+	}
+	l.cond.Broadcast()
+}
+
+// isResourceError reports whether err means the system ran out of processes
+// or file descriptors, either while starting git or within git itself.
+func isResourceError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+		return true
+	}
+	message := err.Error()
+	return strings.Contains(message, "Too many open files") || strings.Contains(message, "Resource temporarily unavailable")
+}
@@ -0,0 +1,159 @@
+package filetree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestLimiter(t *testing.T) {
+	resource := errors.New("fork/exec git: resource temporarily unavailable: Resource temporarily unavailable")
+	tests := []struct {
+		name     string
+		max      int
+		releases []error
+		want     int
+	}{
+		{"starts at max", 8, nil, 8},
+		{"halves", 8, []error{resource}, 4},
+		{"halves repeatedly", 8, []error{resource, resource, resource, resource, resource}, 1},
+		{"other failures keep the cap", 8, []error{errors.New("exit status 128")}, 8},
+		{"creeps back up", 8, []error{resource, nil, nil, nil, nil}, 5},
+		{"needs a full run", 8, []error{resource, nil, nil, nil}, 4},
+		{"failure restarts the run", 8, []error{resource, nil, nil, nil, resource, nil}, 2},
+		{"never above max", 2, []error{nil, nil, nil, nil}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLimiter(tt.max)
+			for _, err := range tt.releases {
+				l.acquire()
+				l.release(err)
+			}
+			if l.limit != tt.want {
+				t.Errorf("limit %d, want %d", l.limit, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimiterBlocks(t *testing.T) {
+	l := newLimiter(1)
+	l.acquire()
+	acquired := make(chan struct{})
+	go func() {
+		l.acquire()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("second acquire didn't wait for a release")
+	default:
+	}
+	l.release(nil)
+	<-acquired
+	l.release(nil)
+}
+
+func TestIsResourceError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{syscall.EAGAIN, true},
+		{fmt.Errorf("fork/exec git: %w", syscall.EMFILE), true},
+		{&os.PathError{Op: "open", Path: "f", Err: syscall.ENFILE}, true},
+		{errors.New("exit status 128: fatal: Too many open files"), true},
+		{errors.New("exit status 128: fatal: Resource temporarily unavailable"), true},
+		{errors.New("exit status 128: fatal: no such path"), false},
+	}
+	for _, tt := range tests {
+		if got := isResourceError(tt.err); got != tt.want {
+			t.Errorf("isResourceError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// flakyGit puts a wrapper around git first on PATH that fails the first
+// failures blame calls with message on stderr and runs the real git for
+// everything else.
+func flakyGit(t *testing.T, failures int, message string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the git wrapper is a shell script")
+	}
+	realGit, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found")
+	}
+	bin := t.TempDir()
+	count := filepath.Join(bin, "count")
+	script := fmt.Sprintf(`#!/bin/sh
+case " $* " in
+*" blame "*)
+	n=$(cat %[1]q 2>/dev/null || echo 0)
+	echo $((n + 1)) > %[1]q
+	if [ "$n" -lt %[2]d ]; then
+		echo %[3]q >&2
+		exit 128
+	fi
+esac
+exec %[4]q "$@"
+`, count, failures, message, realGit)
+	if err := os.WriteFile(filepath.Join(bin, "git"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestBlameRetries(t *testing.T) {
+	const (
+		locked    = "fatal: Unable to create '.git/index.lock': File exists."
+		exhausted = "fatal: Resource temporarily unavailable"
+		missing   = "fatal: no such path 'f.go' in HEAD"
+	)
+	tests := []struct {
+		name     string
+		failures int
+		message  string
+		retries  int
+		wantErr  bool
+	}{
+		{"transient within retries", 2, locked, 2, false},
+		{"transient beyond retries", 2, locked, 1, true},
+		{"transient without retries", 1, locked, 0, true},
+		{"resource regardless of retries", 2, exhausted, 0, false},
+		{"permanent", 1, missing, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newTestRepo(t)
+			repo.commit("alice@x.org", map[string]string{"f.go": "a\n"})
+			flakyGit(t, tt.failures, tt.message)
+
+			var blameErr error
+			opts := Options{Retries: tt.retries, Jobs: 1}
+			opts.OnBlameError = func(path string, err error) { blameErr = err }
+			tree, err := Walk(context.Background(), repo.dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr {
+				if blameErr == nil || tree.Total != 0 {
+					t.Errorf("blame error %v, total %d; want the file to fail", blameErr, tree.Total)
+				}
+				return
+			}
+			if blameErr != nil || tree.Total != 1 {
+				t.Errorf("blame error %v, total %d; want the retry to succeed", blameErr, tree.Total)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package filetree
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// VerifyRef checks that ref names a commit in the repository containing dir.
+func VerifyRef(dir, ref string) error {
+	_, err := ResolveCommit(dir, ref)
+	return err
+}
+
+// ResolveCommit returns the full sha of the commit ref names in the
+// repository containing dir.
+func ResolveCommit(dir, ref string) (string, error) {
+	verify := exec.Command("git", "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	verify.Dir = dir
+	output, err := verify.Output()
+	if err != nil {
+		return "", fmt.Errorf("unknown revision %q", ref)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// walkRef builds the tree rooted at w.root from the files git tracks at
+// opts.Blame.Ref rather than from the working directory, queueing every file
+// above the depth limit for blame. Only the root's ignore patterns apply,
+// since nested .gitignore files are read from the working directory.
+func (w *walker) walkRef() (*Node, error) {
+	// Inside a subdirectory, ls-tree lists only the paths below it,
+	// relative to it
+	list := exec.CommandContext(w.ctx, "git", "ls-tree", "-r", "-l", "-z", w.opts.Blame.Ref)
+	list.Dir = w.root
+	output, err := list.Output()
+	if err != nil {
+		if w.ctx.Err() != nil {
+			return nil, w.ctx.Err()
+		}
+		return nil, fmt.Errorf("git ls-tree failed: %v", err)
+	}
+
+	root := &Node{Name: filepath.Base(w.root), Type: NodeDir, path: w.root}
+	dirs := map[string]*Node{"": root}
+	scopes := []patternScope{{patterns: w.opts.Patterns}}
+
+	for _, record := range bytes.Split(output, []byte{0}) {
+		entry, ok := parseTreeEntry(string(record))
+		if !ok || entry.objectType != "blob" {
+			continue
+		}
+		segments := strings.Split(entry.path, "/")
+		if !w.includeRefFile(segments, scopes) {
+			continue
+		}
+
+		// Create the directories leading to the entry. Below the depth
+		// limit, the entry is only counted toward the directory at the
+		// limit.
+		deep := w.opts.Depth > 0 && len(segments) > w.opts.Depth
+		dirSegments := segments[:len(segments)-1]
+		if deep {
+			dirSegments = segments[:w.opts.Depth]
+		}
+		parent := root
+		for i := range dirSegments {
+			dirPath := path.Join(segments[:i+1]...)
+			dir, ok := dirs[dirPath]
+			if !ok {
+				dir = &Node{Name: segments[i], Type: NodeDir, path: filepath.Join(w.root, dirPath), truncated: deep && i == len(dirSegments)-1}
+				dirs[dirPath] = dir
+				parent.Children = append(parent.Children, dir)
+			}
+			parent = dir
+		}
+		if deep {
+			parent.files++
+			parent.kept++
+			parent.Size += entry.size
+			continue
+		}
+
+		name := segments[len(segments)-1]
+		file := &Node{Name: name, Type: NodeFile, path: filepath.Join(w.root, entry.path), Size: entry.size, blob: entry.object}
+		parent.Children = append(parent.Children, file)
+		if w.opts.NoBlame {
+			if w.opts.MinLines > 0 {
+				file.Total = countBlobLines(w.root, entry.object)
+			}
+			continue
+		}
+		if file.Binary = isBinaryBlob(w.root, entry.object); file.Binary {
+			continue
+		}
+		w.files = append(w.files, file)
+		if w.opts.MaxFiles > 0 && len(w.files) > w.opts.MaxFiles {
+			return nil, fmt.Errorf("%w: more than %d", ErrTooManyFiles, w.opts.MaxFiles)
+		}
+	}
+
+	// git lists entries in name order, so only the directories need moving
+	if w.opts.DirsFirst {
+		for _, dir := range dirs {
+			sortEntries(dir.Children, true, func(a, b *Node) bool { return false })
+		}
+	}
+	return root, nil
+}
+
+// includeRefFile reports whether the file at the path made of segments is
+// walked, given the walk's hidden, ignore and include-only settings.
+func (w *walker) includeRefFile(segments []string, scopes []patternScope) bool {
+	for _, segment := range segments {
+		if !w.opts.ShowHidden && strings.HasPrefix(segment, ".") {
+			return false
+		}
+	}
+	relPath := w.matchPath(path.Join(segments...))
+	if matchesScopes(relPath, false, scopes) {
+		return false
+	}
+	return len(w.opts.IncludeOnly) == 0 || MatchesGitignore(relPath, w.opts.IncludeOnly)
+}
+
+// isBinaryBlob reports whether the blob sha in the repository containing dir
+// looks like binary data, as isBinary does for files on disk. Only the start
+// of the blob is read. Blobs that can't be read are left for git blame to
+// report.
+func isBinaryBlob(dir, sha string) bool {
+	show := exec.Command("git", "cat-file", "blob", sha)
+	show.Dir = dir
+	stdout, err := show.StdoutPipe()
+	if err != nil {
+		return false
+	}
+	if err := show.Start(); err != nil {
+		return false
+	}
+	binary := hasNUL(stdout)
+	// The rest of a large blob isn't needed
+	show.Process.Kill()
+	show.Wait()
+	return binary
+}
+
+// countBlobLines returns the number of lines in the blob sha in the
+// repository containing dir, as countLines does for files on disk.
+func countBlobLines(dir, sha string) int {
+	show := exec.Command("git", "cat-file", "blob", sha)
+	show.Dir = dir
+	output, err := show.Output()
+	if err != nil {
+		return 0
+	}
+	return lineCount(output)
+}
+
+// treeEntry is one record of git ls-tree -l output.
+type treeEntry struct {
+	objectType string
+	object     string
+	size       int64
+	path       string
+}
+
+// parseTreeEntry parses a "<mode> <type> <object> <size>\t<path>" record.
+func parseTreeEntry(record string) (treeEntry, bool) {
+	meta, entryPath, ok := strings.Cut(record, "\t")
+	if !ok {
+		return treeEntry{}, false
+	}
+	fields := strings.Fields(meta)
+	if len(fields) != 4 {
+		return treeEntry{}, false
+	}
+	// Trees and submodules have no size
+	size, _ := strconv.ParseInt(fields[3], 10, 64)
+	return treeEntry{objectType: fields[1], object: fields[2], size: size, path: entryPath}, true
+}
+
+// existingDir returns the closest directory at or above dir that exists, for
+// running git on paths that only exist at another revision.
+func existingDir(dir string) string {
+	for {
+		if fileInfo, err := os.Stat(dir); err == nil && fileInfo.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,73 @@
+package filetree
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+// childByName returns the child of n with the given name, failing the test if
+// there is none.
+func childByName(t *testing.T, n *Node, name string) *Node {
+	t.Helper()
+	for _, child := range n.Children {
+		if child.Name == name {
+			return child
+		}
+	}
+	t.Fatalf("%s has no child %s", n.Name, name)
+	return nil
+}
+
+func TestWalkRefBinary(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.commit("alice@x.org", map[string]string{"a.go": "a\n", "bin.png": "\x89PNG\x00\x01"})
+	repo.git("tag", "v1")
+
+	for _, ref := range []string{"", "v1"} {
+		opts := Options{ShowFiles: true}
+		opts.Blame.Ref = ref
+		tree, err := Walk(context.Background(), repo.dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bin := childByName(t, tree, "bin.png"); !bin.Binary || len(bin.Authors) > 0 {
+			t.Errorf("ref %q: bin.png = %+v, want binary with no authors", ref, bin)
+		}
+		if a := childByName(t, tree, "a.go"); a.Binary || len(a.Authors) != 1 {
+			t.Errorf("ref %q: a.go = %+v, want one author", ref, a)
+		}
+	}
+}
+
+func TestWalkRefMinLinesWithoutBlame(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.commit("alice@x.org", map[string]string{"one.go": "a\n", "three.go": "a\nb\nc"})
+	repo.git("tag", "v1")
+	// The working tree no longer matches the revision
+	repo.write("one.go", "a\nb\nc\nd\n")
+
+	tests := []struct {
+		minLines int
+		want     []string
+	}{
+		{1, []string{"one.go", "three.go"}},
+		{2, []string{"three.go"}},
+		{4, nil},
+	}
+	for _, tt := range tests {
+		opts := Options{ShowFiles: true, NoBlame: true, MinLines: tt.minLines}
+		opts.Blame.Ref = "v1"
+		tree, err := Walk(context.Background(), repo.dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, child := range tree.Children {
+			got = append(got, child.Name)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("MinLines %d: files %v, want %v", tt.minLines, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package filetree
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRepo is a temporary git repository that tests commit files to.
+type testRepo struct {
+	t   *testing.T
+	dir string
+}
+
+// newTestRepo creates an empty repository, isolated from the user's git
+// configuration. The test is skipped if git isn't installed.
+func newTestRepo(t *testing.T) *testRepo {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	r := &testRepo{t: t, dir: t.TempDir()}
+	r.git("init", "-q")
+	return r
+}
+
+// git runs git in the repository and returns its output, failing the test
+// if it fails.
+func (r *testRepo) git(args ...string) string {
+	r.t.Helper()
+	return r.gitEnv(nil, args...)
+}
+
+// gitEnv runs git like git, with env added to its environment.
+func (r *testRepo) gitEnv(env []string, args ...string) string {
+	r.t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.dir
+	cmd.Env = append(os.Environ(), env...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, output)
+	}
+	return string(output)
+}
+
+// write creates or replaces the file name, relative to the repository root,
+// without committing it.
+func (r *testRepo) write(name, content string) {
+	r.t.Helper()
+	path := filepath.Join(r.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		r.t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// commit writes files and commits every change in the repository as the
+// author with the given email.
+func (r *testRepo) commit(email string, files map[string]string) {
+	r.t.Helper()
+	r.commitAt(email, time.Time{}, files)
+}
+
+// commitAt is like commit, with the author time set to when unless it is
+// zero.
+func (r *testRepo) commitAt(email string, when time.Time, files map[string]string) {
+	r.t.Helper()
+	for name, content := range files {
+		r.write(name, content)
+	}
+	name, _, _ := strings.Cut(email, "@")
+	var env []string
+	if !when.IsZero() {
+		env = append(env, "GIT_AUTHOR_DATE="+when.Format(time.RFC3339))
+	}
+	r.git("add", "-A")
+	r.gitEnv(env, "-c", "user.name="+name, "-c", "user.email="+email, "commit", "-q", "--allow-empty", "-m", "commit by "+name)
+}
@@ -0,0 +1,420 @@
+package filetree
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseTOML parses the subset of TOML used by .filetree.toml: tables, arrays
+// of tables, dotted and quoted keys, strings, integers, floats, booleans,
+// arrays and inline tables. Tables are returned as nested maps and arrays,
+// including arrays of tables, as []any.
+func parseTOML(data string) (map[string]any, error) {
+	p := &tomlParser{src: strings.ReplaceAll(data, "\r\n", "\n"), line: 1}
+	doc := make(map[string]any)
+	table := doc
+
+	for {
+		p.skipBlank()
+		if p.done() {
+			return resolveTableArrays(doc), nil
+		}
+
+		if strings.HasPrefix(p.src[p.pos:], "[[") {
+			p.pos += len("[[")
+			keys, err := p.parseKey()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace()
+			if !strings.HasPrefix(p.src[p.pos:], "]]") {
+				return nil, p.errorf("expected ]] after array of tables name")
+			}
+			p.pos += len("]]")
+			if table, err = appendTable(doc, keys); err != nil {
+				return nil, p.errorf("%v", err)
+			}
+		} else if p.peek() == '[' {
+			p.pos++
+			keys, err := p.parseKey()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace()
+			if p.done() || p.peek() != ']' {
+				return nil, p.errorf("expected ] after table name")
+			}
+			p.pos++
+			if table, err = subTable(doc, keys); err != nil {
+				return nil, p.errorf("%v", err)
+			}
+		} else {
+			keys, err := p.parseKey()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace()
+			if p.done() || p.peek() != '=' {
+				return nil, p.errorf("expected = after key")
+			}
+			p.pos++
+			p.skipSpace()
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+
+			parent, err := subTable(table, keys[:len(keys)-1])
+			if err != nil {
+				return nil, p.errorf("%v", err)
+			}
+			key := keys[len(keys)-1]
+			if _, exists := parent[key]; exists {
+				return nil, p.errorf("duplicate key %q", key)
+			}
+			parent[key] = value
+		}
+
+		if err := p.endLine(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// subTable returns the table reached by following keys from table, creating
+// any tables that don't exist yet. A key naming an array of tables leads to
+// its last table.
+func subTable(table map[string]any, keys []string) (map[string]any, error) {
+	for _, key := range keys {
+		value, exists := table[key]
+		if !exists {
+			child := make(map[string]any)
+			table[key] = child
+			table = child
+			continue
+		}
+		switch child := value.(type) {
+		case map[string]any:
+			table = child
+		case *tableArray:
+			table = child.tables[len(child.tables)-1]
+		default:
+			return nil, fmt.Errorf("key %q is not a table", key)
+		}
+	}
+	return table, nil
+}
+
+// tableArray is an array of tables built up by [[name]] headers, which
+// resolveTableArrays turns into a plain array once the document is parsed.
+type tableArray struct {
+	tables []map[string]any
+}
+
+// appendTable adds a table to the array of tables reached by following keys
+// from doc, creating the array if it doesn't exist yet, and returns the new
+// table.
+func appendTable(doc map[string]any, keys []string) (map[string]any, error) {
+	parent, err := subTable(doc, keys[:len(keys)-1])
+	if err != nil {
+		return nil, err
+	}
+	key := keys[len(keys)-1]
+	array, ok := parent[key].(*tableArray)
+	if !ok {
+		if _, exists := parent[key]; exists {
+			return nil, fmt.Errorf("key %q is not an array of tables", key)
+		}
+		array = &tableArray{}
+		parent[key] = array
+	}
+	table := make(map[string]any)
+	array.tables = append(array.tables, table)
+	return table, nil
+}
+
+// resolveTableArrays replaces every array of tables under table with a
+// plain array of its tables, and returns table.
+func resolveTableArrays(table map[string]any) map[string]any {
+	for key, value := range table {
+		switch v := value.(type) {
+		case map[string]any:
+			resolveTableArrays(v)
+		case *tableArray:
+			values := make([]any, len(v.tables))
+			for i, t := range v.tables {
+				values[i] = resolveTableArrays(t)
+			}
+			table[key] = values
+		}
+	}
+	return table
+}
+
+type tomlParser struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (p *tomlParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *tomlParser) done() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *tomlParser) peek() byte {
+	return p.src[p.pos]
+}
+
+// skipSpace skips spaces and tabs on the current line.
+func (p *tomlParser) skipSpace() {
+	for !p.done() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.pos++
+	}
+}
+
+// skipComment skips a comment running to the end of the current line.
+func (p *tomlParser) skipComment() {
+	if !p.done() && p.peek() == '#' {
+		for !p.done() && p.peek() != '\n' {
+			p.pos++
+		}
+	}
+}
+
+// skipBlank skips whitespace, newlines and comments.
+func (p *tomlParser) skipBlank() {
+	for {
+		p.skipSpace()
+		p.skipComment()
+		if p.done() || p.peek() != '\n' {
+			return
+		}
+		p.pos++
+		p.line++
+	}
+}
+
+// endLine requires that nothing but a comment follows on the current line.
+func (p *tomlParser) endLine() error {
+	p.skipSpace()
+	p.skipComment()
+	if p.done() {
+		return nil
+	}
+	if p.peek() != '\n' {
+		return p.errorf("unexpected %q after value", p.peek())
+	}
+	return nil
+}
+
+// parseKey parses a dotted key made of bare or quoted parts.
+func (p *tomlParser) parseKey() ([]string, error) {
+	var keys []string
+	for {
+		p.skipSpace()
+		if p.done() {
+			return nil, p.errorf("expected key")
+		}
+
+		switch c := p.peek(); {
+		case c == '"' || c == '\'':
+			key, err := p.parseString()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		case isBareKeyChar(c):
+			start := p.pos
+			for !p.done() && isBareKeyChar(p.peek()) {
+				p.pos++
+			}
+			keys = append(keys, p.src[start:p.pos])
+		default:
+			return nil, p.errorf("invalid key character %q", c)
+		}
+
+		p.skipSpace()
+		if p.done() || p.peek() != '.' {
+			return keys, nil
+		}
+		p.pos++
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (p *tomlParser) parseValue() (any, error) {
+	if p.done() {
+		return nil, p.errorf("expected value")
+	}
+
+	switch c := p.peek(); {
+	case c == '"' || c == '\'':
+		return p.parseString()
+	case c == '[':
+		return p.parseArray()
+	case c == '{':
+		return p.parseInlineTable()
+	case strings.HasPrefix(p.src[p.pos:], "true"):
+		p.pos += len("true")
+		return true, nil
+	case strings.HasPrefix(p.src[p.pos:], "false"):
+		p.pos += len("false")
+		return false, nil
+	default:
+		return p.parseNumber()
+	}
+}
+
+// parseString parses a basic "..." string with escapes or a literal '...'
+// string.
+func (p *tomlParser) parseString() (string, error) {
+	quote := p.peek()
+	p.pos++
+
+	var sb strings.Builder
+	for !p.done() {
+		c := p.peek()
+		p.pos++
+		switch {
+		case c == quote:
+			return sb.String(), nil
+		case c == '\n':
+			return "", p.errorf("unterminated string")
+		case c == '\\' && quote == '"':
+			if p.done() {
+				return "", p.errorf("unterminated string")
+			}
+			escaped := p.peek()
+			p.pos++
+			switch escaped {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case '"', '\\':
+				sb.WriteByte(escaped)
+			default:
+				return "", p.errorf("invalid escape \\%c", escaped)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// parseArray parses an array, which may span several lines.
+func (p *tomlParser) parseArray() ([]any, error) {
+	p.pos++
+	values := []any{}
+	for {
+		p.skipBlank()
+		if p.done() {
+			return nil, p.errorf("unterminated array")
+		}
+		if p.peek() == ']' {
+			p.pos++
+			return values, nil
+		}
+
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		p.skipBlank()
+		if p.done() {
+			return nil, p.errorf("unterminated array")
+		}
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+		default:
+			return nil, p.errorf("expected , or ] in array")
+		}
+	}
+}
+
+// parseInlineTable parses a { key = value, ... } table, which must fit on one
+// line.
+func (p *tomlParser) parseInlineTable() (map[string]any, error) {
+	p.pos++
+	table := make(map[string]any)
+	p.skipSpace()
+	if !p.done() && p.peek() == '}' {
+		p.pos++
+		return table, nil
+	}
+	for {
+		keys, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.done() || p.peek() != '=' {
+			return nil, p.errorf("expected = after key")
+		}
+		p.pos++
+		p.skipSpace()
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+
+		parent, err := subTable(table, keys[:len(keys)-1])
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		key := keys[len(keys)-1]
+		if _, exists := parent[key]; exists {
+			return nil, p.errorf("duplicate key %q", key)
+		}
+		parent[key] = value
+
+		p.skipSpace()
+		if p.done() {
+			return nil, p.errorf("unterminated inline table")
+		}
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return table, nil
+		default:
+			return nil, p.errorf("expected , or } in inline table")
+		}
+	}
+}
+
+func (p *tomlParser) parseNumber() (any, error) {
+	start := p.pos
+	for !p.done() && strings.IndexByte("+-.0123456789_eE", p.peek()) >= 0 {
+		p.pos++
+	}
+	token := strings.ReplaceAll(p.src[start:p.pos], "_", "")
+	if token == "" {
+		return nil, p.errorf("invalid value")
+	}
+
+	if n, err := strconv.ParseInt(token, 10, 64); err == nil {
+		return n, nil
+	}
+	f, err := strconv.ParseFloat(token, 64)
+	if err != nil {
+		return nil, p.errorf("invalid number %q", token)
+	}
+	return f, nil
+}
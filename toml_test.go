@@ -0,0 +1,63 @@
+package filetree
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want map[string]any
+	}{
+		{"values", "s = \"a\\tb\"\nl = 'c:\\dir'\ni = 1_000\nf = -2.5\nb = true\n",
+			map[string]any{"s": "a\tb", "l": `c:\dir`, "i": int64(1000), "f": -2.5, "b": true}},
+		{"arrays", "a = [\n  1, # one\n  [2, 3],\n]\ne = []\n",
+			map[string]any{"a": []any{int64(1), []any{int64(2), int64(3)}}, "e": []any{}}},
+		{"tables", "top = 1\n[a.\"b.c\"]\nx = 2\n[d]\ny.z = { w = 3 }\n",
+			map[string]any{"top": int64(1), "a": map[string]any{"b.c": map[string]any{"x": int64(2)}}, "d": map[string]any{"y": map[string]any{"z": map[string]any{"w": int64(3)}}}}},
+		{"arrays of tables", "[[rule]]\nabove = 50\n\n[[rule]]\nabove = 0\n[rule.style]\nbold = true\n",
+			map[string]any{"rule": []any{
+				map[string]any{"above": int64(50)},
+				map[string]any{"above": int64(0), "style": map[string]any{"bold": true}},
+			}}},
+		{"nested arrays of tables", "[[t.a]]\nx = 1\n[[t.a.b]]\ny = 2\n[[t.a]]\n",
+			map[string]any{"t": map[string]any{"a": []any{
+				map[string]any{"x": int64(1), "b": []any{map[string]any{"y": int64(2)}}},
+				map[string]any{},
+			}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTOML() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"a = 1\na = 2\n", `line 2: duplicate key "a"`},
+		{"a = 1\n[a]\n", `key "a" is not a table`},
+		{"a = [1]\n[[a]]\n", `line 2: key "a" is not an array of tables`},
+		{"[[a]]\na = 1\n[[a]\n", "line 3: expected ]] after array of tables name"},
+		{"[[a]]\n[a.b]\nc = 1\nc = 2\n", `line 4: duplicate key "c"`},
+		{"s = \"open\n", "unterminated string"},
+		{"a = 1 2\n", "unexpected"},
+	}
+	for _, tt := range tests {
+		if _, err := parseTOML(tt.data); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseTOML(%q) error = %v, want one mentioning %q", tt.data, err, tt.want)
+		}
+	}
+}